@@ -0,0 +1,248 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+)
+
+// Nicknames for the formats in the default Apache httpd.conf
+var apacheFormatNicknames = map[string]string{
+	"common":         `%h %l %u %t "%r" %>s %b`,
+	"combined":       `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"`,
+	"combinedio":     `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i" %I %O`,
+	"vhost_combined": `%v:%p %h %l %u %t "%r" %>s %O "%{Referer}i" "%{User-Agent}i"`,
+}
+
+// Apache format directives and the nginx variable with the same value
+var apacheDirectives = map[byte]string{
+	'a': "remote_addr",
+	'A': "server_addr",
+	'b': "body_bytes_sent",
+	'B': "body_bytes_sent",
+	'D': "request_time_us",
+	'f': "request_filename",
+	'h': "remote_addr",
+	'H': "server_protocol",
+	'I': "request_length",
+	'k': "connection_requests",
+	'l': "remote_logname",
+	'L': "request_log_id",
+	'm': "request_method",
+	'O': "bytes_sent",
+	'p': "server_port",
+	'P': "pid",
+	'q': "query_string",
+	'r': "request",
+	'R': "handler",
+	's': "status",
+	'S': "bytes_transferred",
+	't': "time_local",
+	'T': "request_time",
+	'u': "remote_user",
+	'U': "uri",
+	'v': "server_name",
+	'V': "server_name",
+	'X': "connection_status",
+}
+
+// Build a logPattern from an Apache LogFormat string like
+// '%h %l %u %t "%r" %>s %b', or one of the default nicknames.
+func compileApacheFormat(format string) (*logPattern, error) {
+	if nickname, ok := apacheFormatNicknames[format]; ok {
+		format = nickname
+	}
+
+	var literals []string
+	var fields []string
+	var timeLayout, timePattern string
+
+	// Split the format into literal text and %directives, so that
+	// literals[i] is the text before fields[i].
+	var literal strings.Builder
+	addField := func(name string) {
+		literals = append(literals, literal.String())
+		literal.Reset()
+		fields = append(fields, name)
+	}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+		start := i
+		i++
+
+		// Skip modifiers, like the > in %>s or the status codes in %!200,304{Referer}i
+		for i < len(format) && strings.IndexByte("<>!,0123456789", format[i]) != -1 {
+			i++
+		}
+
+		var arg string
+		if i < len(format) && format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated directive at position %d", start)
+			}
+			arg = format[i+1 : i+end]
+			i += end + 1
+		}
+		if i >= len(format) {
+			return nil, fmt.Errorf("incomplete directive at position %d", start)
+		}
+
+		directive := format[i]
+		switch {
+		case directive == '%':
+			literal.WriteByte('%')
+		case directive == 't' && arg == "":
+			// %t is the time in brackets, like [10/Oct/2000:13:55:36 -0700]
+			literal.WriteByte('[')
+			addField("time_local")
+			literal.WriteByte(']')
+		case directive == 't':
+			arg = strings.TrimPrefix(strings.TrimPrefix(arg, "begin:"), "end:")
+			switch arg {
+			case "sec":
+				addField("msec")
+			case "msec":
+				addField("time_msec")
+			case "usec":
+				addField("time_usec")
+			case "msec_frac", "usec_frac":
+				addField("time_" + arg)
+			default:
+				if timeLayout != "" {
+					return nil, fmt.Errorf("only one custom time directive is supported, at position %d", start)
+				}
+				layout, pattern, err := strftimeToLayout(arg)
+				if err != nil {
+					return nil, fmt.Errorf("invalid time directive at position %d: %w", start, err)
+				}
+				timeLayout, timePattern = layout, pattern
+				addField("time_custom")
+			}
+		case directive == 'i' && arg != "":
+			// Request header, named like the nginx $http_ variables
+			addField("http_" + headerVariableName(arg))
+		case directive == 'o' && arg != "":
+			addField("sent_http_" + headerVariableName(arg))
+		case directive == 'C' && arg != "":
+			addField("cookie_" + arg)
+		case directive == 'e' && arg != "":
+			addField("env_" + arg)
+		case directive == 'n' && arg != "":
+			addField("note_" + arg)
+		case directive == 'T' && arg != "":
+			switch arg {
+			case "s":
+				addField("request_time")
+			case "ms":
+				addField("request_time_ms")
+			case "us":
+				addField("request_time_us")
+			default:
+				return nil, fmt.Errorf("unknown time unit %q at position %d", arg, start)
+			}
+		case apacheDirectives[directive] != "":
+			addField(apacheDirectives[directive])
+		default:
+			return nil, fmt.Errorf("unsupported directive %%%c at position %d", directive, start)
+		}
+	}
+	literals = append(literals, literal.String())
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("log format has no directives")
+	}
+
+	patterns := nginxVariablePatterns
+	if timePattern != "" {
+		patterns = maps.Clone(nginxVariablePatterns)
+		patterns["time_custom"] = timePattern
+	}
+	pattern, err := buildLogPattern(literals, fields, patterns)
+	if err != nil {
+		return nil, err
+	}
+	pattern.timeLayout = timeLayout
+
+	return pattern, nil
+}
+
+// Name a header like nginx does, User-Agent becomes user_agent
+func headerVariableName(header string) string {
+	return strings.ReplaceAll(strings.ToLower(header), "-", "_")
+}
+
+// strftime conversions, with the matching Go time layout and a regex
+// matching the values
+var strftimeConversions = map[byte]struct{ layout, pattern string }{
+	'a': {"Mon", `[A-Za-z]{3}`},
+	'A': {"Monday", `[A-Za-z]+`},
+	'b': {"Jan", `[A-Za-z]{3}`},
+	'B': {"January", `[A-Za-z]+`},
+	'd': {"02", `\d{2}`},
+	'e': {"_2", `[ \d]\d`},
+	'F': {"2006-01-02", `\d{4}-\d{2}-\d{2}`},
+	'h': {"Jan", `[A-Za-z]{3}`},
+	'H': {"15", `\d{2}`},
+	'I': {"03", `\d{2}`},
+	'j': {"002", `\d{3}`},
+	'm': {"01", `\d{2}`},
+	'M': {"04", `\d{2}`},
+	'p': {"PM", `[AP]M`},
+	'S': {"05", `\d{2}`},
+	'T': {"15:04:05", `\d{2}:\d{2}:\d{2}`},
+	'y': {"06", `\d{2}`},
+	'Y': {"2006", `\d{4}`},
+	'z': {"-0700", `[+-]\d{4}`},
+	'Z': {"MST", `[A-Za-z]+`},
+	'%': {"%", `%`},
+}
+
+// Convert a strftime format, as used in %{format}t, to a Go time layout,
+// and a regex matching the times. The time can have spaces and other
+// characters that end other fields, so it needs its own pattern.
+func strftimeToLayout(format string) (string, string, error) {
+	var layout, pattern strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			layout.WriteByte(format[i])
+			pattern.WriteString(regexp.QuoteMeta(format[i : i+1]))
+			continue
+		}
+		i++
+		if i >= len(format) {
+			return "", "", fmt.Errorf("incomplete conversion in %q", format)
+		}
+		conversion, ok := strftimeConversions[format[i]]
+		if !ok {
+			return "", "", fmt.Errorf("unsupported conversion %%%c in %q", format[i], format)
+		}
+		layout.WriteString(conversion.layout)
+		pattern.WriteString(conversion.pattern)
+	}
+	return layout.String(), pattern.String(), nil
+}
@@ -0,0 +1,156 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Columns of a CloudFront standard log, used until the #Fields header of
+// the log file has been read.
+var cloudFrontFields = []string{
+	"date", "time", "x-edge-location", "sc-bytes", "c-ip", "cs-method", "cs(Host)",
+	"cs-uri-stem", "sc-status", "cs(Referer)", "cs(User-Agent)", "cs-uri-query",
+	"cs(Cookie)", "x-edge-result-type", "x-edge-request-id", "x-host-header",
+	"cs-protocol", "cs-bytes", "time-taken", "x-forwarded-for", "ssl-protocol",
+	"ssl-cipher", "x-edge-response-result-type", "cs-protocol-version",
+	"fle-status", "fle-encrypted-fields", "c-port", "time-to-first-byte",
+	"x-edge-detailed-result-type", "sc-content-type", "sc-content-len",
+	"sc-range-start", "sc-range-end",
+}
+
+// CloudFront standard logs are W3C logs with tab separated, URL-encoded
+// values and time-taken in seconds.
+func newCloudFrontFormat() *w3cFormat {
+	return &w3cFormat{
+		separator:     "\t",
+		fields:        cloudFrontFields,
+		timeTakenUnit: time.Second,
+		decode: func(field, value string) string {
+			// URLs are logged as requested, with their own encoding
+			if strings.HasPrefix(field, "cs-uri") {
+				return value
+			}
+			if decoded, err := url.PathUnescape(value); err == nil {
+				return decoded
+			}
+			return value
+		},
+	}
+}
+
+// An albFormat parses AWS Application Load Balancer access logs.
+type albFormat struct{}
+
+// Example: https 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.086 0.048 0.037 200 200 0 57 "GET https://www.example.com:443/ HTTP/1.1" "curl/7.46.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337281-1d84f3d73c47ec4e58577259" "www.example.com" ...
+func (albFormat) parse(line string) (*LogData, error) {
+	fields := splitQuotedFields(line)
+	if len(fields) < 14 {
+		return nil, fmt.Errorf("line has %d fields, an ALB log has at least 14", len(fields))
+	}
+
+	logData := &LogData{
+		Timestamp: fields[1],
+		Status:    fields[8],
+		Size:      fields[11],
+		UserAgent: fields[13],
+	}
+	if logData.UserAgent == "-" {
+		logData.UserAgent = ""
+	}
+
+	// The client is logged as ip:port
+	if host, _, err := net.SplitHostPort(fields[3]); err == nil {
+		logData.IP = host
+	} else {
+		logData.IP = fields[3]
+	}
+
+	// The request time is the sum of the times of the load balancer and
+	// the target, each one is -1 if the request failed.
+	for _, field := range fields[5:8] {
+		if duration := parseDuration(field, time.Second); duration > 0 {
+			logData.Duration += duration
+		}
+	}
+
+	// The request line has the full URL, like "GET https://www.example.com:443/ HTTP/1.1"
+	parts := strings.Fields(fields[12])
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid request %q", fields[12])
+	}
+	logData.Method = parts[0]
+	logData.Protocol = parts[2]
+	requestURL, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid request URL: %w", err)
+	}
+	logData.Scheme = requestURL.Scheme
+	logData.Host = requestURL.Hostname()
+	logData.URL = requestURL.RequestURI()
+
+	// Prefer the TLS server name, if the client sent one
+	if len(fields) > 18 && fields[18] != "-" && fields[18] != "" {
+		logData.Host = fields[18]
+	}
+
+	return logData, nil
+}
+
+// Split a line on spaces, keeping double quoted values together.
+func splitQuotedFields(line string) []string {
+	var fields []string
+	for i := 0; i < len(line); {
+		if line[i] == ' ' {
+			i++
+			continue
+		}
+
+		if line[i] != '"' {
+			end := strings.IndexByte(line[i:], ' ')
+			if end == -1 {
+				end = len(line) - i
+			}
+			fields = append(fields, line[i:i+end])
+			i += end
+			continue
+		}
+
+		// Quoted value, where quotes inside are escaped with a backslash
+		end := i + 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		value := line[i+1 : min(end, len(line))]
+		if strings.IndexByte(value, '\\') != -1 {
+			value = unescapeLogValue(value)
+		}
+		fields = append(fields, value)
+		i = end + 1
+	}
+	return fields
+}
@@ -4,25 +4,112 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
-const batchSize = 200
+// Defaults of batch.size, batch.max_wait and batch.max_bytes
+const (
+	defaultBatchSize     = 200
+	defaultBatchMaxWait  = 10 * time.Second
+	defaultBatchMaxBytes = 1024 * 1024
+)
 
 var logBuffer []url.Values
 var bufferMutex sync.Mutex
 
+// Held while a batch is sent, so batches are sent in order
+var sendMutex sync.Mutex
+
+// Functions to call for the logs in logBuffer once they are sent
+var bufferAcks []func()
+
+// Log lines of the logs in logBuffer
+var bufferLines []string
+
+// Size of the logs in logBuffer in the batch payload, and when the oldest
+// of them was added
+var bufferBytes int
+var bufferStarted time.Time
+
+// Send the logs in the buffer as a batch. The buffer is not locked while
+// the batch is sent, so logs can be added meanwhile, and batches are sent
+// one at a time, in order.
 func sendBatch(config *Config) {
+	sendMutex.Lock()
+	defer sendMutex.Unlock()
+
+	// Take the logs out of the buffer
+	bufferMutex.Lock()
+	requests, lines, acks := logBuffer, bufferLines, bufferAcks
+	logBuffer, bufferLines, bufferAcks = nil, nil, nil
+	bufferBytes = 0
+	bufferMutex.Unlock()
+
 	// Check if there's anything to send
-	if len(logBuffer) == 0 {
+	if len(requests) == 0 {
 		return
 	}
 
-	batchRequests := make([]string, len(logBuffer))
-	for i, log := range logBuffer {
+	handled, err := deliverBatch(config, deliveryStopped, requests, lines)
+	if err != nil {
+		logger.Errorf("Error sending batch to Matomo: %v", err)
+	}
+	for _, ack := range acks[:handled] {
+		ack()
+	}
+	if handled == len(requests) {
+		return
+	}
+
+	// Delivery stopped before all logs were sent, the rest are put back in
+	// front of the buffer, for flushBatch
+	bufferMutex.Lock()
+	defer bufferMutex.Unlock()
+	for _, log := range requests[handled:] {
+		bufferBytes += requestSize(log)
+	}
+	if len(logBuffer) == 0 {
+		bufferStarted = time.Now()
+	}
+	logBuffer = append(requests[handled:], logBuffer...)
+	bufferLines = append(lines[handled:], bufferLines...)
+	bufferAcks = append(acks[handled:], bufferAcks...)
+}
+
+// Deliver a batch with retries. Matomo tracks the requests of a batch in
+// order, so when it fails partway, only the requests it did not get to are
+// sent again, or rejected. Returns how many requests, from the start, are
+// done, and errDeliveryStopped when stop is closed before all are done.
+func deliverBatch(config *Config, stop <-chan struct{}, requests []url.Values, lines []string) (int, error) {
+	handled := 0
+	err := deliver(config, stop, func() error {
+		sent, err := postBatch(requests[handled:], lines[handled:], config)
+		handled += sent
+		if handled == len(requests) {
+			return nil
+		}
+		return err
+	})
+	if isRetryable(err) {
+		return handled, err
+	} else if err != nil {
+		rejectRequests(requests[handled:], lines[handled:], err)
+	}
+	return len(requests), nil
+}
+
+// Send tracking requests to Matomo in one request, with the bulk tracking
+// API. Returns how many requests, from the start, Matomo tracked or found
+// invalid, and an error if Matomo could not be reached, is unavailable or
+// rejected the rest of the batch.
+func postBatch(requests []url.Values, lines []string, config *Config) (int, error) {
+	batchRequests := make([]string, len(requests))
+	for i, log := range requests {
 		// Use url.Values.Encode() to format the query string correctly
 		encodedLog := log.Encode() // Automatically handles URL encoding and concatenates with '&'
 
@@ -39,8 +126,7 @@ func sendBatch(config *Config) {
 	// Marshal the payload into JSON
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		logger.Errorf("Error marshalling JSON payload: %v", err)
-		return
+		return 0, &rejectedError{reason: fmt.Sprintf("error marshalling JSON payload: %v", err)}
 	}
 
 	payloadString := string(jsonData)
@@ -59,50 +145,197 @@ func sendBatch(config *Config) {
 	logger.Infof("Curl command to send this request: %s", curlCommand) // Log the curl command
 
 	// Log the final JSON payload for debugging
-	logger.Infof("Sending batch request with %d logs: %s", len(logBuffer), string(jsonData))
+	logger.Infof("Sending batch request with %d logs: %s", len(requests), string(jsonData))
 
 	// Send the JSON payload to Matomo
 	targetURL := config.Matomo.TrackerURL
 	req, err := http.NewRequest("POST", targetURL+"matomo.php", bytes.NewBuffer(jsonData))
 
 	if err != nil {
-		logger.Errorf("Error creating HTTP request: %v", err)
-		return
+		return 0, fmt.Errorf("error creating HTTP request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "Log-Agent/1.0")
 
 	// Execute the HTTP request
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := matomoClient.Do(req)
 	if err != nil {
-		logger.Errorf("Error sending batch to Matomo: %v", err)
-		return
+		return 0, err
 	}
 	defer resp.Body.Close()
 
-	logger.Infof("Batch sent: %d logs, Status: %s", len(logBuffer), resp.Status)
+	// An error response can still tell how much of the batch was tracked
+	statusErr := checkResponse(resp)
+	result, err := readBulkResponse(resp)
+	if err != nil {
+		return 0, err
+	}
+	if result == nil {
+		if statusErr != nil {
+			return 0, statusErr
+		}
+		// Like from the agent plugin, or a proxy that doesn't pass on the
+		// body, so Matomo took the batch, but it's not known how much of it
+		logger.Warnf("Bulk response is not JSON, it is unknown how many of the %d hits were tracked, Status: %s", len(requests), resp.Status)
+		delivered.unknown.Add(int64(len(requests)))
+		for _, log := range requests {
+			recordSentDate(log.Get("idsite"), log.Get("cdt"))
+		}
+		return len(requests), nil
+	}
+
+	// Matomo stops at the first request it fails on, the requests before it
+	// are tracked or invalid
+	handled := len(requests)
+	if statusErr == nil && result.Status != "success" {
+		statusErr = &unavailableError{status: fmt.Sprintf("%s, batch failed with %s", resp.Status, result.Status)}
+	}
+	if statusErr != nil {
+		handled = max(0, min(result.Tracked+result.Invalid, len(requests)))
+		logger.Warnf("Batch failed after %d of %d logs, tracked %d, invalid %d, Status: %s", handled, len(requests), result.Tracked, result.Invalid, resp.Status)
+	} else {
+		logger.Infof("Batch sent: %d logs, tracked %d, invalid %d, Status: %s", len(requests), result.Tracked, result.Invalid, resp.Status)
+	}
 
-	// Clear the log buffer after sending
-	logBuffer = nil
+	// Only the invalid requests are rejected, the rest has been tracked
+	invalid := make(map[int]bool)
+	var rejected []url.Values
+	var rejectedLines []string
+	for _, index := range result.InvalidIndices {
+		if index >= 0 && index < handled && !invalid[index] {
+			invalid[index] = true
+			rejected = append(rejected, requests[index])
+			if index < len(lines) {
+				rejectedLines = append(rejectedLines, lines[index])
+			}
+		}
+	}
+	if result.Invalid > len(rejected) {
+		// Matomo only tells which requests are invalid to authenticated
+		// requests
+		logger.Warnf("Matomo found %d invalid hits in the batch, but not which", result.Invalid-len(rejected))
+	}
+	if len(rejected) > 0 {
+		deadLetterRequests(rejected, rejectedLines, "invalid request in batch")
+	}
+	delivered.tracked.Add(int64(result.Tracked))
+	delivered.invalid.Add(int64(result.Invalid))
+
+	for i, log := range requests[:handled] {
+		if !invalid[i] {
+			recordSentDate(log.Get("idsite"), log.Get("cdt"))
+		}
+	}
+	return handled, statusErr
+}
+
+// Response of the bulk tracking API
+type bulkResponse struct {
+	Status         string `json:"status"`
+	Tracked        int    `json:"tracked"`
+	Invalid        int    `json:"invalid"`
+	InvalidIndices []int  `json:"invalid_indices"`
+}
+
+// Read the response of the bulk tracking API. Returns no response if the
+// body is not a response of the bulk tracking API.
+func readBulkResponse(resp *http.Response) (*bulkResponse, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading bulk response: %v", err)
+	}
+
+	var result bulkResponse
+	if err := json.Unmarshal(body, &result); err != nil || result.Status == "" {
+		logger.Debugf("Bulk response: %s", body)
+		return nil, nil
+	}
+	return &result, nil
 }
 
-func addLogToBatch(log url.Values, config *Config) {
+// Add a log to the batch. ack, if not nil, is called when the batch with
+// the log has been sent. The batch is sent when it has batch.size logs, or
+// would get larger than batch.max_bytes with the log.
+func addLogToBatch(log url.Values, line string, config *Config, ack func()) {
 	logger.Infof("Log added to batch")
+	if ack == nil {
+		ack = func() {}
+	}
 
-	// Locking the buffer for safe access in concurrent environments
+	// Locking the buffer for safe access in concurrent environments. It is
+	// unlocked to send the batch.
 	bufferMutex.Lock()
-	defer bufferMutex.Unlock()
+	size := requestSize(log)
+	if config.Batch.MaxBytes > 0 && len(logBuffer) > 0 && bufferBytes+size > config.Batch.MaxBytes {
+		logger.Infof("Batch size %d bytes", bufferBytes)
+		bufferMutex.Unlock()
+		sendBatch(config)
+		bufferMutex.Lock()
+	}
 
+	if len(logBuffer) == 0 {
+		bufferStarted = time.Now()
+	}
 	logBuffer = append(logBuffer, log)
+	bufferLines = append(bufferLines, line)
+	bufferAcks = append(bufferAcks, ack)
+	bufferBytes += size
 
 	// Check if the batch size is reached
-	if len(logBuffer) >= batchSize {
+	full := len(logBuffer) >= config.Batch.Size
+	if full {
 		logger.Infof("Batch length %d", len(logBuffer))
+	}
+	bufferMutex.Unlock()
+
+	if full {
 		sendBatch(config)
 	}
 }
 
+// Size of a request in the batch payload, with its quotes and comma
+func requestSize(request url.Values) int {
+	return len(request.Encode()) + 4
+}
+
+// Send the batch once its oldest log has waited batch.max_wait, so logs
+// don't wait for a full batch on quiet sites. Runs until the agent stops.
+func runBatchFlusher(config *Config) {
+	if config.Batch.MaxWait <= 0 {
+		return
+	}
+
+	// Check often enough to send batches at most a quarter late
+	ticker := time.NewTicker(max(config.Batch.MaxWait/4, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-deliveryStopped:
+			return
+		}
+
+		bufferMutex.Lock()
+		waited := len(logBuffer) > 0 && time.Since(bufferStarted) >= config.Batch.MaxWait
+		if waited {
+			logger.Infof("Batch waited %s, sending %d logs", config.Batch.MaxWait, len(logBuffer))
+		}
+		bufferMutex.Unlock()
+
+		if waited {
+			sendBatch(config)
+		}
+	}
+}
+
 func flushBatch(config *Config) {
 	sendBatch(config) // Send any remaining logs
+
+	bufferMutex.Lock()
+	defer bufferMutex.Unlock()
+	if len(logBuffer) > 0 {
+		delivered.failed.Add(int64(len(logBuffer)))
+		logger.Errorf("Failed to send the last %d logs in the batch", len(logBuffer))
+	}
 }
@@ -0,0 +1,262 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An answer of the bulk tracking API
+type bulkAnswer struct {
+	status int
+	body   string
+}
+
+// A bulk tracking API that answers with the answers in order, and then
+// tracks every batch. Returns the urls of the hits in every batch it got.
+func testBulkTracker(t *testing.T, answers ...bulkAnswer) (*httptest.Server, func() [][]string) {
+	var mutex sync.Mutex
+	var batches [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Requests []string `json:"requests"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("batch is not JSON: %v", err)
+		}
+		var urls []string
+		for _, request := range payload.Requests {
+			values, _ := url.ParseQuery(strings.TrimPrefix(request, "?"))
+			urls = append(urls, values.Get("url"))
+		}
+
+		mutex.Lock()
+		batches = append(batches, urls)
+		n := len(batches)
+		mutex.Unlock()
+
+		answer := bulkAnswer{http.StatusOK, fmt.Sprintf(`{"status":"success","tracked":%d,"invalid":0}`, len(urls))}
+		if n <= len(answers) {
+			answer = answers[n-1]
+		}
+		w.WriteHeader(answer.status)
+		fmt.Fprint(w, answer.body)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() [][]string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return batches
+	}
+}
+
+func testBatch(count int) ([]url.Values, []string) {
+	requests := make([]url.Values, count)
+	lines := make([]string, count)
+	for i := range requests {
+		requests[i] = url.Values{"idsite": {"1"}, "url": {fmt.Sprintf("/page/%d", i)}}
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	return requests, lines
+}
+
+// Write dead letters to a temporary file, and return a function reading the
+// urls of the dead-lettered hits
+func testDeadLetters(t *testing.T) func() []string {
+	path := filepath.Join(t.TempDir(), "dead-letters.json")
+	if err := openDeadLetters(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		deadLetterFile.Close()
+		deadLetterFile = nil
+	})
+
+	return func() []string {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		var urls []string
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record deadLetter
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatalf("invalid dead letter %s: %v", scanner.Text(), err)
+			}
+			values, _ := url.ParseQuery(record.Request)
+			urls = append(urls, values.Get("url"))
+		}
+		return urls
+	}
+}
+
+func TestPostBatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		answer    bulkAnswer
+		handled   int
+		retryable bool
+		rejected  bool
+		unknown   int64
+	}{
+		{"success", bulkAnswer{200, `{"status":"success","tracked":5,"invalid":0}`}, 5, false, false, 0},
+		{"error status with tracked", bulkAnswer{500, `{"status":"error","tracked":2,"invalid":1}`}, 3, true, false, 0},
+		{"error in success status", bulkAnswer{200, `{"status":"error","tracked":4,"invalid":0}`}, 4, true, false, 0},
+		{"client error with tracked", bulkAnswer{400, `{"status":"error","tracked":1,"invalid":0}`}, 1, false, true, 0},
+		{"more handled than sent", bulkAnswer{503, `{"status":"error","tracked":9,"invalid":0}`}, 5, true, false, 0},
+		{"not JSON", bulkAnswer{200, `ok`}, 5, false, false, 5},
+		{"unavailable not JSON", bulkAnswer{503, `<html>busy</html>`}, 0, true, false, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, _ := testBulkTracker(t, test.answer)
+			config := testRetryConfig(server.URL)
+			requests, lines := testBatch(5)
+
+			unknown := delivered.unknown.Load()
+			handled, err := postBatch(requests, lines, config)
+			if handled != test.handled {
+				t.Errorf("handled %d, want %d", handled, test.handled)
+			}
+			var rejected *rejectedError
+			if isRetryable(err) != test.retryable || errors.As(err, &rejected) != test.rejected {
+				t.Errorf("got %v, want retryable %v, rejected %v", err, test.retryable, test.rejected)
+			}
+			if got := delivered.unknown.Load() - unknown; got != test.unknown {
+				t.Errorf("counted %d unknown hits, want %d", got, test.unknown)
+			}
+		})
+	}
+}
+
+func TestDeliverBatchRetriesTheRest(t *testing.T) {
+	matomoBreaker = &circuitBreaker{}
+	server, batches := testBulkTracker(t,
+		bulkAnswer{503, `{"status":"error","tracked":2,"invalid":0}`},
+		bulkAnswer{500, `{"status":"error","tracked":0,"invalid":0}`},
+	)
+	config := testRetryConfig(server.URL)
+	requests, lines := testBatch(5)
+
+	tracked := delivered.tracked.Load()
+	handled, err := deliverBatch(config, nil, requests, lines)
+	if err != nil || handled != 5 {
+		t.Fatalf("handled %d: %v", handled, err)
+	}
+
+	// The hits Matomo tracked are not sent again
+	got := batches()
+	want := [][]string{
+		{"/page/0", "/page/1", "/page/2", "/page/3", "/page/4"},
+		{"/page/2", "/page/3", "/page/4"},
+		{"/page/2", "/page/3", "/page/4"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+	if got := delivered.tracked.Load() - tracked; got != 5 {
+		t.Errorf("tracked %d hits, want 5", got)
+	}
+}
+
+func TestDeliverBatchInvalidIndicesOfTheRest(t *testing.T) {
+	matomoBreaker = &circuitBreaker{}
+	deadLetters := testDeadLetters(t)
+	server, _ := testBulkTracker(t,
+		bulkAnswer{500, `{"status":"error","tracked":1,"invalid":1,"invalid_indices":[1]}`},
+		// Indices are of the retried rest, this is /page/3
+		bulkAnswer{200, `{"status":"success","tracked":2,"invalid":1,"invalid_indices":[1]}`},
+	)
+	config := testRetryConfig(server.URL)
+	requests, lines := testBatch(5)
+
+	invalid := delivered.invalid.Load()
+	handled, err := deliverBatch(config, nil, requests, lines)
+	if err != nil || handled != 5 {
+		t.Fatalf("handled %d: %v", handled, err)
+	}
+	if got := strings.Join(deadLetters(), " "); got != "/page/1 /page/3" {
+		t.Errorf("dead-lettered %s, want /page/1 /page/3", got)
+	}
+	if got := delivered.invalid.Load() - invalid; got != 2 {
+		t.Errorf("counted %d invalid hits, want 2", got)
+	}
+}
+
+func TestDeliverBatchRejectsTheRest(t *testing.T) {
+	matomoBreaker = &circuitBreaker{}
+	deadLetters := testDeadLetters(t)
+	server, batches := testBulkTracker(t,
+		bulkAnswer{400, `{"status":"error","tracked":2,"invalid":0}`},
+	)
+	config := testRetryConfig(server.URL)
+	requests, lines := testBatch(5)
+
+	rejected := delivered.rejected.Load()
+	handled, err := deliverBatch(config, nil, requests, lines)
+	if err != nil || handled != 5 {
+		t.Fatalf("handled %d: %v", handled, err)
+	}
+	if len(batches()) != 1 {
+		t.Errorf("sent %d batches, a rejected batch is not sent again", len(batches()))
+	}
+	if got := strings.Join(deadLetters(), " "); got != "/page/2 /page/3 /page/4" {
+		t.Errorf("dead-lettered %s, want /page/2 /page/3 /page/4", got)
+	}
+	if got := delivered.rejected.Load() - rejected; got != 3 {
+		t.Errorf("rejected %d hits, want 3", got)
+	}
+}
+
+func TestDeliverBatchStops(t *testing.T) {
+	matomoBreaker = &circuitBreaker{}
+	server, _ := testBulkTracker(t,
+		bulkAnswer{503, `{"status":"error","tracked":3,"invalid":0}`},
+	)
+	config := testRetryConfig(server.URL)
+	requests, lines := testBatch(5)
+
+	config.Retry.InitialBackoff = time.Hour
+	config.Retry.MaxBackoff = time.Hour
+
+	// Stopped while waiting to retry the rest
+	stop := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	handled, err := deliverBatch(config, stop, requests, lines)
+	if !errors.Is(err, errDeliveryStopped) || handled != 3 {
+		t.Errorf("handled %d: %v, want 3 handled and errDeliveryStopped", handled, err)
+	}
+}
@@ -0,0 +1,123 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Struct of a Caddy access log entry, as written by the "log" directive.
+type caddyLogEntry struct {
+	TS      json.RawMessage `json:"ts"`
+	Request *struct {
+		RemoteIP string              `json:"remote_ip"`
+		ClientIP string              `json:"client_ip"`
+		Proto    string              `json:"proto"`
+		Method   string              `json:"method"`
+		Host     string              `json:"host"`
+		URI      string              `json:"uri"`
+		Headers  map[string][]string `json:"headers"`
+		TLS      *json.RawMessage    `json:"tls"`
+	} `json:"request"`
+	UserID   string          `json:"user_id"`
+	Duration json.RawMessage `json:"duration"`
+	Size     int64           `json:"size"`
+	Status   int             `json:"status"`
+}
+
+// A caddyFormat parses Caddy JSON access logs.
+type caddyFormat struct{}
+
+func (caddyFormat) parse(line string) (*LogData, error) {
+	var entry caddyLogEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	// Caddy logs other messages than requests to the same log
+	if entry.Request == nil {
+		return nil, errSkipLine
+	}
+	request := entry.Request
+
+	logData := &LogData{
+		IP:       request.ClientIP,
+		Host:     request.Host,
+		Scheme:   "http",
+		Method:   request.Method,
+		URL:      request.URI,
+		Protocol: request.Proto,
+		Status:   strconv.Itoa(entry.Status),
+		Size:     strconv.FormatInt(entry.Size, 10),
+		User:     entry.UserID,
+		Duration: caddyDuration(entry.Duration),
+	}
+
+	// client_ip is only logged by Caddy 2.7 and later
+	if logData.IP == "" {
+		logData.IP = request.RemoteIP
+	}
+	if request.TLS != nil {
+		logData.Scheme = "https"
+	}
+
+	// Header names are logged as sent by Go, normally in canonical form
+	headers := make(http.Header)
+	for name, values := range request.Headers {
+		headers[http.CanonicalHeaderKey(name)] = values
+	}
+	logData.Referrer = headers.Get("Referer")
+	logData.UserAgent = headers.Get("User-Agent")
+
+	// ts is seconds since the epoch, or a string if the log has a
+	// custom time_format
+	var ts interface{}
+	if err := json.Unmarshal(entry.TS, &ts); err == nil {
+		switch v := ts.(type) {
+		case float64:
+			logData.Timestamp = epochTimestamp(strconv.FormatFloat(v, 'f', -1, 64), time.Second)
+		case string:
+			logData.Timestamp = v
+		}
+	}
+
+	return logData, nil
+}
+
+// Caddy logs the duration as float seconds, older versions as a Go
+// duration string like "1.2ms".
+func caddyDuration(raw json.RawMessage) time.Duration {
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if duration, err := time.ParseDuration(text); err == nil {
+			return duration
+		}
+	}
+	return 0
+}
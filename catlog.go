@@ -0,0 +1,206 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A catlog run, with the checkpoints it saves its progress in
+type catRun struct {
+	checkpoints *checkpointStore
+	// Start every log at its checkpoint, with --resume
+	resume   bool
+	progress *progress
+	// Closed on SIGINT or SIGTERM
+	stopped chan struct{}
+}
+
+// If the run has been stopped, and no more lines should be sent
+func (run *catRun) isStopped() bool {
+	select {
+	case <-run.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// A log read in catlog mode. It knows the offset of every line, so the
+// offset of the last line sent can be saved, and an import that stopped
+// can be resumed there.
+type catReader struct {
+	config  *Config
+	parser  *logParser
+	reader  *logReader
+	lines   *bufio.Reader
+	file    fileID
+	tracker *offsetTracker
+	// Offset in the log, after decompressing, of the next line
+	offset int64
+}
+
+// Size of the buffer lines are read with, the fingerprint of a log is taken
+// from a first line that fits in it
+const catReaderBufferSize = 64 * 1024
+
+// Open a log in catlog mode. With --resume it starts at the checkpoint of
+// the log, and with --since at the lines from since on, in an uncompressed
+// log.
+func openCatReader(config *Config, run *catRun) (*catReader, error) {
+	path := config.Log.LogPath
+
+	// Every log needs its own parser, the format may be detected per log
+	parser, err := newLogParser(config)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := openLogReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+
+	r := &catReader{
+		config: config,
+		parser: parser,
+		reader: reader,
+		lines:  bufio.NewReaderSize(reader, catReaderBufferSize),
+	}
+	run.progress.add(r)
+
+	// Pipes have no position to save
+	if isPipe(path) {
+		return r, nil
+	}
+
+	if info, err := reader.file.Stat(); err == nil {
+		r.file.Device, r.file.Inode = fileIdentity(info)
+	}
+	// A short read is the whole log
+	first, _ := r.lines.Peek(catReaderBufferSize)
+	if end := bytes.IndexByte(first, '\n'); end >= 0 {
+		r.file.Fingerprint = lineFingerprint(string(first[:end+1]))
+	}
+	r.tracker = run.checkpoints.tracker(path)
+
+	start := int64(0)
+	if run.resume {
+		start = run.checkpoints.importOffset(path, r.file)
+	}
+	if since := config.Window.Since; !since.IsZero() && !reader.compressed {
+		if offset, err := seekSince(reader.file, config, since); err != nil {
+			logger.Warnf("Failed to seek to %s in %s, reading from the start: %v", since, path, err)
+		} else if offset > start {
+			start = offset
+		}
+	}
+	if start > 0 {
+		if err := r.skip(start); err != nil {
+			r.close()
+			return nil, fmt.Errorf("failed to skip to offset %d in %s: %v", start, path, err)
+		}
+		run.progress.skip(reader.rawOffset())
+		logger.Infof("Starting %s at offset %d", path, start)
+	}
+
+	return r, nil
+}
+
+// Skip to offset. The lines before the first request are parsed, for
+// formats like W3C that need their header lines. An uncompressed log is
+// moved to the offset, a compressed one is read up to it.
+func (r *catReader) skip(offset int64) error {
+	for r.offset < offset {
+		text, err := r.lines.ReadString('\n')
+		r.offset += int64(len(text))
+		if err != nil {
+			return err
+		}
+		if _, err := r.parser.lineFormat.parse(strings.TrimRight(text, "\r\n")); err != errSkipLine {
+			break
+		}
+	}
+	if r.offset >= offset {
+		return nil
+	}
+
+	if err := r.reader.seek(offset); err == nil {
+		r.lines.Reset(r.reader)
+		r.offset = offset
+		return nil
+	}
+	skipped, err := io.CopyN(io.Discard, r.lines, offset-r.offset)
+	r.offset += skipped
+	return err
+}
+
+// Read the next line to send. Lines that are not sent, because they have no
+// request, can't be parsed or are outside --since and --until, are done
+// right away. The returned function marks the line as done, when it has
+// been sent. Returns io.EOF at the end of the log, or when the log has
+// passed --until.
+func (r *catReader) next() (*LogData, func(), error) {
+	for {
+		text, err := r.lines.ReadString('\n')
+		if text == "" {
+			if err == nil {
+				err = io.EOF
+			}
+			return nil, nil, err
+		} else if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		r.offset += int64(len(text))
+		line := strings.TrimRight(text, "\r\n")
+		ack := r.tracker.track(followedLine{Text: line, Offset: r.offset, File: r.file})
+
+		// Parse the log line
+		logData, err := r.parser.parseLog(line)
+		if err == errSkipLine {
+			ack()
+			continue
+		} else if err != nil {
+			logger.Warnf("Failed to parse log line: %s (%v)", line, err)
+			deadLetterLine(r.config.Log.LogPath, r.parser, line, err)
+			ack()
+			continue
+		}
+
+		// Skip lines outside --since and --until
+		if r.config.Window.passed(logData) {
+			return nil, nil, io.EOF
+		}
+		if !r.config.Window.includes(logData) {
+			ack()
+			continue
+		}
+
+		return logData, ack, nil
+	}
+}
+
+func (r *catReader) close() {
+	r.reader.Close()
+}
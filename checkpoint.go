@@ -0,0 +1,316 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How often changed checkpoints are written to the state file
+const checkpointSaveInterval = time.Second
+
+// Read position in a log file. The device, inode and fingerprint of the
+// first line tell if the file at the path is still the same file.
+type checkpoint struct {
+	Device      uint64    `json:"device"`
+	Inode       uint64    `json:"inode"`
+	Offset      int64     `json:"offset"`
+	Fingerprint string    `json:"fingerprint"`
+	Updated     time.Time `json:"updated"`
+}
+
+// Sections of the state file. Tailing and catlog imports keep their
+// checkpoints apart, so a backfill doesn't move the read position of the
+// log the agent tails.
+const (
+	tailCheckpoints   = "files"
+	importCheckpoints = "imports"
+)
+
+// The state file, with the checkpoints of every section by path
+type stateFile map[string]map[string]*checkpoint
+
+// Checkpoints of all inputs, kept in a section of the state file.
+type checkpointStore struct {
+	path    string
+	section string
+	mutex   sync.Mutex
+	files   map[string]*checkpoint
+	// Paths whose checkpoint changed since the last save
+	changed map[string]bool
+}
+
+// Load the checkpoints of a section from the state file. Without a state
+// file path, nothing is loaded or saved and every log is read from the
+// start.
+func loadCheckpoints(path, section string) (*checkpointStore, error) {
+	store := &checkpointStore{
+		path:    path,
+		section: section,
+		files:   make(map[string]*checkpoint),
+		changed: make(map[string]bool),
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	state, err := readStateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if files := state[section]; files != nil {
+		store.files = files
+	}
+
+	return store, nil
+}
+
+// Read all sections of the state file, none if it doesn't exist yet
+func readStateFile(path string) (stateFile, error) {
+	state := make(stateFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// Offset to start reading the log at path from. That is the checkpoint, if
+// the file is still the same, else the start of the file.
+func (s *checkpointStore) resumeOffset(path string) int64 {
+	s.mutex.Lock()
+	saved, ok := s.files[path]
+	s.mutex.Unlock()
+	if !ok {
+		return 0
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	device, inode := fileIdentity(info)
+	fingerprint := ""
+	if file, err := os.Open(path); err == nil {
+		fingerprint = readFingerprint(file)
+		file.Close()
+	}
+
+	switch {
+	case device != saved.Device || inode != saved.Inode:
+		logger.Infof("%s is a new file since the last checkpoint, reading from the start", path)
+	case fingerprint != saved.Fingerprint:
+		logger.Infof("%s has been rewritten since the last checkpoint, reading from the start", path)
+	case info.Size() < saved.Offset:
+		logger.Infof("%s has been truncated since the last checkpoint, reading from the start", path)
+	default:
+		logger.Infof("Resuming %s at offset %d", path, saved.Offset)
+		return saved.Offset
+	}
+	return 0
+}
+
+// Offset to resume a catlog import of the log at path from. That is the
+// checkpoint, if it is of the same file, else the start of the file. For
+// compressed logs the offset is in the decompressed log.
+func (s *checkpointStore) importOffset(path string, file fileID) int64 {
+	s.mutex.Lock()
+	saved, ok := s.files[path]
+	s.mutex.Unlock()
+
+	switch {
+	case !ok:
+		return 0
+	case saved.Device != file.Device || saved.Inode != file.Inode || saved.Fingerprint != file.Fingerprint:
+		logger.Infof("%s is not the file of the last checkpoint, reading from the start", path)
+		return 0
+	}
+	return saved.Offset
+}
+
+// Set the checkpoint of the log at path, for a line read from file
+func (s *checkpointStore) commit(path string, file fileID, offset int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	saved, ok := s.files[path]
+	if !ok || saved.Device != file.Device || saved.Inode != file.Inode ||
+		saved.Fingerprint != file.Fingerprint || offset < saved.Offset {
+		// A new file, or the file has been rotated or truncated
+		saved = &checkpoint{Device: file.Device, Inode: file.Inode, Fingerprint: file.Fingerprint}
+		s.files[path] = saved
+	}
+	saved.Offset = offset
+	saved.Updated = time.Now()
+	s.changed[path] = true
+}
+
+// Write the checkpoints to the state file, if they have changed. The file
+// is replaced in one go, so it is never half written. Another agent, like a
+// catlog import next to the tailing agent, may use the same state file, so
+// it is locked while the changed checkpoints are merged into what is in it.
+func (s *checkpointStore) save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.path == "" || len(s.changed) == 0 {
+		return nil
+	}
+
+	// The state file itself is replaced, so the lock is on a file next to it
+	lock, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to lock state file: %w", err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock, true); err != nil {
+		return fmt.Errorf("failed to lock state file: %w", err)
+	}
+
+	state, err := readStateFile(s.path)
+	if err != nil {
+		return err
+	}
+	if state[s.section] == nil {
+		state[s.section] = make(map[string]*checkpoint)
+	}
+	for path := range s.changed {
+		state[s.section][path] = s.files[path]
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	s.changed = make(map[string]bool)
+	return nil
+}
+
+// Save the checkpoints every checkpointSaveInterval until stop is closed,
+// and then a last time.
+func (s *checkpointStore) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(checkpointSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			if err := s.save(); err != nil {
+				logger.Errorf("Failed to save checkpoints: %v", err)
+			}
+			return
+		}
+		if err := s.save(); err != nil {
+			logger.Errorf("Failed to save checkpoints: %v", err)
+		}
+	}
+}
+
+// Hash of the first line of a file, with its newline
+func lineFingerprint(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:])
+}
+
+// An offsetTracker commits the offsets of lines in order, once the lines
+// and all lines before them are done. Lines are done when their hit has
+// been sent to Matomo, or when there is nothing to send.
+type offsetTracker struct {
+	store   *checkpointStore
+	path    string
+	mutex   sync.Mutex
+	pending []*trackedOffset
+}
+
+type trackedOffset struct {
+	line followedLine
+	done bool
+}
+
+func (s *checkpointStore) tracker(path string) *offsetTracker {
+	return &offsetTracker{store: s, path: path}
+}
+
+// Track a line, the returned function marks it as done. Without a tracker,
+// like for pipes, nothing is tracked.
+func (t *offsetTracker) track(line followedLine) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	tracked := &trackedOffset{line: line}
+
+	t.mutex.Lock()
+	t.pending = append(t.pending, tracked)
+	t.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.done(tracked) })
+	}
+}
+
+func (t *offsetTracker) done(tracked *trackedOffset) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	tracked.done = true
+	var committed *followedLine
+	for len(t.pending) > 0 && t.pending[0].done {
+		committed = &t.pending[0].line
+		t.pending = t.pending[1:]
+	}
+	if committed != nil {
+		t.store.commit(t.path, committed.File, committed.Offset)
+	}
+}
@@ -0,0 +1,122 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Struct of a Cloudflare Logpush record of the HTTP requests dataset. Only
+// the fields used for tracking, the job decides which fields are pushed.
+type cloudflareLogEntry struct {
+	ClientIP               string          `json:"ClientIP"`
+	ClientRequestHost      string          `json:"ClientRequestHost"`
+	ClientRequestMethod    string          `json:"ClientRequestMethod"`
+	ClientRequestProtocol  string          `json:"ClientRequestProtocol"`
+	ClientRequestScheme    string          `json:"ClientRequestScheme"`
+	ClientRequestURI       string          `json:"ClientRequestURI"`
+	ClientRequestReferer   string          `json:"ClientRequestReferer"`
+	ClientRequestUserAgent string          `json:"ClientRequestUserAgent"`
+	EdgeResponseStatus     int             `json:"EdgeResponseStatus"`
+	EdgeResponseBytes      int64           `json:"EdgeResponseBytes"`
+	EdgeStartTimestamp     json.RawMessage `json:"EdgeStartTimestamp"`
+	EdgeEndTimestamp       json.RawMessage `json:"EdgeEndTimestamp"`
+	RayID                  string          `json:"RayID"`
+}
+
+// A cloudflareFormat parses Cloudflare Logpush NDJSON files.
+type cloudflareFormat struct{}
+
+func (cloudflareFormat) parse(line string) (*LogData, error) {
+	var entry cloudflareLogEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if entry.ClientRequestURI == "" {
+		return nil, fmt.Errorf("no ClientRequestURI, is this the HTTP requests dataset?")
+	}
+
+	logData := &LogData{
+		IP:        entry.ClientIP,
+		Host:      entry.ClientRequestHost,
+		Scheme:    entry.ClientRequestScheme,
+		Method:    entry.ClientRequestMethod,
+		URL:       entry.ClientRequestURI,
+		Protocol:  entry.ClientRequestProtocol,
+		Status:    strconv.Itoa(entry.EdgeResponseStatus),
+		Size:      strconv.FormatInt(entry.EdgeResponseBytes, 10),
+		Referrer:  entry.ClientRequestReferer,
+		UserAgent: entry.ClientRequestUserAgent,
+	}
+	if entry.RayID != "" {
+		logData.Fields = map[string]string{"RayID": entry.RayID}
+	}
+
+	start, err := cloudflareTime(entry.EdgeStartTimestamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EdgeStartTimestamp: %w", err)
+	}
+	logData.Timestamp = start.Format(time.RFC3339Nano)
+
+	if end, err := cloudflareTime(entry.EdgeEndTimestamp); err == nil && end.After(start) {
+		logData.Duration = end.Sub(start)
+	}
+
+	return logData, nil
+}
+
+// Logpush jobs write timestamps as RFC3339 strings, or as seconds or
+// nanoseconds since the epoch.
+func cloudflareTime(raw json.RawMessage) (time.Time, error) {
+	var timestamp interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&timestamp); err != nil {
+		return time.Time{}, err
+	}
+
+	switch v := timestamp.(type) {
+	case string:
+		return time.Parse(time.RFC3339Nano, v)
+	case json.Number:
+		number, err := v.Int64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		// Tell the unit from the size, seconds since the epoch have 10
+		// digits until the year 2286
+		switch {
+		case number > 1e17:
+			return time.Unix(0, number).UTC(), nil
+		case number > 1e14:
+			return time.UnixMicro(number).UTC(), nil
+		case number > 1e11:
+			return time.UnixMilli(number).UTC(), nil
+		default:
+			return time.Unix(number, 0).UTC(), nil
+		}
+	default:
+		return time.Time{}, fmt.Errorf("unexpected value %v", v)
+	}
+}
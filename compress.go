@@ -0,0 +1,221 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic bytes at the start of compressed files
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// If a file starts with the magic bytes of a compression format
+func isCompressed(magic []byte) bool {
+	return bytes.HasPrefix(magic, gzipMagic) || bytes.HasPrefix(magic, bzip2Magic) || bytes.HasPrefix(magic, zstdMagic)
+}
+
+// If the log at path is an uncompressed regular file, that can be read from
+// any offset
+func isSeekable(path string) bool {
+	if isPipe(path) {
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(zstdMagic))
+	n, _ := io.ReadFull(file, magic)
+	return !isCompressed(magic[:n])
+}
+
+// A log being read, decompressed if it was compressed
+type logReader struct {
+	io.Reader
+	file       *os.File
+	compressed bool
+	// Bytes read from the file, before decompressing
+	raw      *countingReader
+	buffered *bufio.Reader
+	closers  []func() error
+}
+
+func (r *logReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if closeErr := r.closers[i](); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Bytes read from the file so far, for the progress of compressed logs
+func (r *logReader) rawOffset() int64 {
+	return r.raw.count.Load()
+}
+
+// Move an uncompressed log to offset. Compressed logs and pipes can't be
+// moved, and have to be read up to the offset instead.
+func (r *logReader) seek(offset int64) error {
+	if r.compressed {
+		return fmt.Errorf("can't seek in a compressed log")
+	}
+	if _, err := r.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.buffered.Reset(r.raw)
+	r.raw.count.Store(offset)
+	return nil
+}
+
+// Counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+// Open a log for reading, stdin for "-". Logs compressed with gzip, bzip2
+// or zstd, like rotated access.log.2.gz, are found by their magic bytes and
+// decompressed on the fly, whatever their name.
+func openLogReader(path string) (*logReader, error) {
+	file, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := &countingReader{reader: file}
+	buffered := bufio.NewReader(raw)
+	reader := &logReader{
+		file:     file,
+		raw:      raw,
+		buffered: buffered,
+		closers:  []func() error{file.Close},
+	}
+
+	// A short file can't be compressed, and is read as it is
+	magic, _ := buffered.Peek(len(zstdMagic))
+	reader.compressed = isCompressed(magic)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		decompressor, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid gzip file %s: %w", path, err)
+		}
+		reader.Reader = decompressor
+		reader.closers = append(reader.closers, decompressor.Close)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		reader.Reader = bzip2.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decompressor, err := zstd.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid zstd file %s: %w", path, err)
+		}
+		reader.Reader = decompressor
+		reader.closers = append(reader.closers, func() error {
+			decompressor.Close()
+			return nil
+		})
+	default:
+		reader.Reader = buffered
+	}
+
+	return reader, nil
+}
+
+// The logs to read in catlog mode for a path. A directory is all the files
+// in it, and a glob all the files matching it. Logs are read oldest first,
+// by modification time, so rotated logs are read in the order they were
+// written.
+func catLogPaths(path string) ([]string, error) {
+	if path == stdinPath {
+		return []string{path}, nil
+	}
+
+	var matches []string
+	if isGlob(path) {
+		var err error
+		if matches, err = filepath.Glob(path); err != nil {
+			return nil, fmt.Errorf("invalid log path %q: %w", path, err)
+		}
+	} else {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return []string{path}, nil
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			matches = append(matches, filepath.Join(path, entry.Name()))
+		}
+	}
+
+	type logFile struct {
+		path     string
+		modified int64
+	}
+	var files []logFile
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, logFile{match, info.ModTime().UnixNano()})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].modified < files[j].modified
+	})
+
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.path
+	}
+	return paths, nil
+}
@@ -21,6 +21,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -35,16 +36,37 @@ type Config struct {
 		TokenAuth  string `mapstructure:"token_auth"`
 		Plugin     bool   `mapstructure:"plugin"`
 		Downloads  bool   `mapstructure:"downloads"`
+		// Invalidate the archived reports of the dates sent in catlog mode
+		InvalidateReports bool `mapstructure:"invalidate_reports"`
 	}
 	Log struct {
-		LogFormat    string   `mapstructure:"log_format"`
-		LogPath      string   `mapstructure:"log_path"`
-		UserAgents   []string `mapstructure:"user_agents"`
-		ExcludedURLs []string `mapstructure:"excluded_urls"`
+		LogFormat       string            `mapstructure:"log_format"`
+		NginxFormat     string            `mapstructure:"nginx_format"`
+		ApacheFormat    string            `mapstructure:"apache_format"`
+		JSONFields      map[string]string `mapstructure:"json_fields"`
+		HAProxyCaptures []string          `mapstructure:"haproxy_captures"`
+		CSV             struct {
+			Delimiter  string            `mapstructure:"delimiter"`
+			Header     bool              `mapstructure:"header"`
+			LazyQuotes bool              `mapstructure:"lazy_quotes"`
+			Columns    map[string]string `mapstructure:"columns"`
+		} `mapstructure:"csv"`
+		LogPath      string        `mapstructure:"log_path"`
+		DetectLines  int           `mapstructure:"detect_lines"`
+		Poll         bool          `mapstructure:"poll"`
+		PollInterval time.Duration `mapstructure:"poll_interval"`
+		UserAgents   []string      `mapstructure:"user_agents"`
+		ExcludedURLs []string      `mapstructure:"excluded_urls"`
 	}
 	Agent struct {
-		LogLevel string `mapstructure:"log_level"`
-		LogFile  string `mapstructure:"log_file"`
+		LogLevel  string `mapstructure:"log_level"`
+		LogFile   string `mapstructure:"log_file"`
+		StateFile string `mapstructure:"state_file"`
+		// File to write hits Matomo rejected, and lines that could not be
+		// parsed, to
+		DeadLetterFile string `mapstructure:"dead_letter_file"`
+		// The older name of dead_letter_file
+		RejectLog string `mapstructure:"reject_log"`
 	}
 	Title struct {
 		Collect bool   `mapstructure:"collect_titles"`
@@ -53,11 +75,75 @@ type Config struct {
 	}
 	Batch struct {
 		Mode bool `mapstructure:"batch"`
+		// A batch is sent when it has size logs, its oldest log has waited
+		// max_wait, or it would get larger than max_bytes
+		Size     int           `mapstructure:"size"`
+		MaxWait  time.Duration `mapstructure:"max_wait"`
+		MaxBytes int           `mapstructure:"max_bytes"`
 	}
+	// Retries of requests to Matomo that failed
+	Retry struct {
+		// Tries after which a failure is logged as an error, not a warning
+		ErrorAfter       int           `mapstructure:"error_after"`
+		InitialBackoff   time.Duration `mapstructure:"initial_backoff"`
+		MaxBackoff       time.Duration `mapstructure:"max_backoff"`
+		BreakerThreshold int           `mapstructure:"breaker_threshold"`
+		BreakerCooldown  time.Duration `mapstructure:"breaker_cooldown"`
+		RequestTimeout   time.Duration `mapstructure:"request_timeout"`
+	}
+	// Spool to keep hits in while Matomo can't be reached
+	Spool struct {
+		Dir        string `mapstructure:"dir"`
+		MaxSizeMB  int    `mapstructure:"max_size_mb"`
+		DropPolicy string `mapstructure:"drop_policy"`
+	}
+	// Logs to tail, from [[input]] blocks. Without inputs, the log in
+	// log.log_path is tailed.
+	Inputs []InputConfig `mapstructure:"input"`
+	// Only send lines in this window, set with --since and --until
+	Window timeWindow `mapstructure:"-"`
+}
+
+// An [[input]] block, for logs matching a path glob. Settings that are not
+// set are taken from [matomo], [log] and [title].
+type InputConfig struct {
+	Path            string            `mapstructure:"path"`
+	LogFormat       string            `mapstructure:"log_format"`
+	NginxFormat     string            `mapstructure:"nginx_format"`
+	ApacheFormat    string            `mapstructure:"apache_format"`
+	JSONFields      map[string]string `mapstructure:"json_fields"`
+	HAProxyCaptures []string          `mapstructure:"haproxy_captures"`
+	CSV             struct {
+		Delimiter  string            `mapstructure:"delimiter"`
+		Header     *bool             `mapstructure:"header"`
+		LazyQuotes *bool             `mapstructure:"lazy_quotes"`
+		Columns    map[string]string `mapstructure:"columns"`
+	} `mapstructure:"csv"`
+	// Poll the files of this input, like for logs on NFS next to local ones
+	Poll          bool          `mapstructure:"poll"`
+	PollInterval  time.Duration `mapstructure:"poll_interval"`
+	SiteID        string        `mapstructure:"site_id"`
+	WebSite       string        `mapstructure:"website_url"`
+	UserAgents    []string      `mapstructure:"user_agents"`
+	ExcludedURLs  []string      `mapstructure:"excluded_urls"`
+	CollectTitles *bool         `mapstructure:"collect_titles"`
+	TitleDomain   string        `mapstructure:"title_domain"`
 }
 
 func loadConfig(configPath string) (*Config, error) {
 	viper.SetConfigFile(configPath)
+	viper.SetDefault("matomo.invalidate_reports", false)
+	viper.SetDefault("batch.size", defaultBatchSize)
+	viper.SetDefault("batch.max_wait", defaultBatchMaxWait)
+	viper.SetDefault("batch.max_bytes", defaultBatchMaxBytes)
+	viper.SetDefault("retry.error_after", 5)
+	viper.SetDefault("retry.initial_backoff", "1s")
+	viper.SetDefault("retry.max_backoff", "1m")
+	viper.SetDefault("retry.breaker_threshold", 5)
+	viper.SetDefault("retry.breaker_cooldown", "30s")
+	viper.SetDefault("retry.request_timeout", "30s")
+	viper.SetDefault("spool.max_size_mb", defaultSpoolMaxSizeMB)
+	viper.SetDefault("spool.drop_policy", spoolDropOldest)
 
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("error reading config file: %w", err)
@@ -67,6 +153,12 @@ func loadConfig(configPath string) (*Config, error) {
 	if err := viper.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("unable to decode into struct: %w", err)
 	}
+	if config.Agent.DeadLetterFile == "" {
+		config.Agent.DeadLetterFile = config.Agent.RejectLog
+	}
+	if config.Batch.Size < 1 {
+		return nil, fmt.Errorf("batch.size must be at least 1, not %d", config.Batch.Size)
+	}
 
 	return &config, nil
 }
@@ -0,0 +1,221 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Default CSV columns: timestamp, req_method, final_host, req_uri, resp_status, client_ip, req_referer, req_user_agent
+//
+// Example: 2024-09-10 18:13:19 UTC,GET,example.org,/news/2024/09/09/south-sudan-parliament-approves-transitional-justice-laws,200,2.86.73.63,https://my.url/,Mozilla/5.0...
+var defaultCSVColumns = map[string]string{
+	"timestamp":  "0",
+	"method":     "1",
+	"host":       "2",
+	"url":        "3",
+	"status":     "4",
+	"ip":         "5",
+	"referrer":   "6",
+	"user_agent": "7",
+}
+
+// A csvFormat parses CSV logs, with columns mapped to LogData fields by
+// index or by the name in a header line. The parser keeps the header
+// between lines, so one parser must read the lines of a log in order.
+type csvFormat struct {
+	comma      rune
+	lazyQuotes bool
+	useHeader  bool
+	// LogData field name to column index or header name
+	columns map[string]string
+	// Column index of each LogData field, set from the header if needed
+	indices    map[string]int
+	header     []string
+	headerLine string
+}
+
+func newCSVFormat(config *Config) (*csvFormat, error) {
+	f := &csvFormat{
+		comma:      ',',
+		lazyQuotes: config.Log.CSV.LazyQuotes,
+		useHeader:  config.Log.CSV.Header,
+		columns:    config.Log.CSV.Columns,
+	}
+
+	delimiter := config.Log.CSV.Delimiter
+	if config.Log.LogFormat == "tsv" || delimiter == "tab" || delimiter == `\t` {
+		delimiter = "\t"
+	}
+	if delimiter != "" {
+		if utf8.RuneCountInString(delimiter) != 1 {
+			return nil, fmt.Errorf("delimiter %q is not a single character", delimiter)
+		}
+		f.comma, _ = utf8.DecodeRuneInString(delimiter)
+	}
+
+	// With a header and no columns, the columns are found by name
+	if len(f.columns) == 0 && !f.useHeader {
+		f.columns = defaultCSVColumns
+	}
+
+	f.indices = make(map[string]int)
+	for name, column := range f.columns {
+		if logDataFieldVariables[name] == "" {
+			return nil, fmt.Errorf("unknown field %q in log.csv.columns", name)
+		}
+		if index, err := strconv.Atoi(column); err == nil {
+			f.indices[name] = index
+		} else if !f.useHeader {
+			return nil, fmt.Errorf("column %q for %s is a name, but log.csv.header is not set", column, name)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *csvFormat) parse(line string) (*LogData, error) {
+	if strings.TrimSpace(line) == "" {
+		return nil, errSkipLine
+	}
+
+	// The first line is the header, and it may come again if logs are
+	// concatenated
+	if f.useHeader && (f.header == nil || line == f.headerLine) {
+		if f.header == nil {
+			if err := f.readHeader(line); err != nil {
+				return nil, err
+			}
+		}
+		return nil, errSkipLine
+	}
+
+	record, err := f.readRecord(line)
+	if err != nil {
+		return nil, err
+	}
+
+	logData := &LogData{}
+	for name, index := range f.indices {
+		if index >= len(record) {
+			return nil, fmt.Errorf("line has %d columns, %s is in column %d", len(record), name, index)
+		}
+		logData.setField(logDataFieldVariables[name], record[index])
+	}
+
+	// Keep the other named columns for later rules
+	for index, name := range f.header {
+		if index < len(record) && !f.isMapped(index) {
+			if logData.Fields == nil {
+				logData.Fields = make(map[string]string)
+			}
+			logData.Fields[name] = record[index]
+		}
+	}
+
+	return logData, nil
+}
+
+// Read the header line and find the columns given by name
+func (f *csvFormat) readHeader(line string) error {
+	header, err := f.readRecord(line)
+	if err != nil {
+		return fmt.Errorf("invalid header: %w", err)
+	}
+
+	if len(f.columns) == 0 {
+		// Map the columns named like a field, or like the nginx variable
+		// for the field
+		for index, title := range header {
+			title = strings.ToLower(strings.TrimSpace(title))
+			for name, variable := range logDataFieldVariables {
+				if title == name || title == variable {
+					f.indices[name] = index
+				}
+			}
+		}
+		if len(f.indices) == 0 {
+			return fmt.Errorf("no known column names in the header")
+		}
+	}
+
+	for name, column := range f.columns {
+		if _, err := strconv.Atoi(column); err == nil {
+			continue
+		}
+		found := false
+		for index, title := range header {
+			if strings.EqualFold(strings.TrimSpace(title), column) {
+				f.indices[name] = index
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("column %q for %s is not in the header", column, name)
+		}
+	}
+
+	f.header = header
+	f.headerLine = line
+	logger.Debugf("CSV header: %s", strings.Join(header, ", "))
+	return nil
+}
+
+func (f *csvFormat) headerLines() []string {
+	if f.headerLine == "" {
+		return nil
+	}
+	return []string{f.headerLine}
+}
+
+func (f *csvFormat) readRecord(line string) ([]string, error) {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.Comma = f.comma
+	reader.LazyQuotes = f.lazyQuotes
+	// In case there are extra spaces. Not with a whitespace delimiter, like
+	// tab, as that would merge the empty columns.
+	reader.TrimLeadingSpace = !unicode.IsSpace(f.comma)
+	reader.FieldsPerRecord = -1
+
+	// Read one record (log line)
+	record, err := reader.Read()
+	if err == io.EOF {
+		return nil, errSkipLine
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	return record, nil
+}
+
+func (f *csvFormat) isMapped(index int) bool {
+	for _, mapped := range f.indices {
+		if mapped == index {
+			return true
+		}
+	}
+	return false
+}
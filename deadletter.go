@@ -0,0 +1,148 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counts of what happened to the hits sent to Matomo
+type deliveryCounts struct {
+	// Tracked by Matomo
+	tracked atomic.Int64
+	// Invalid requests in batches Matomo tracked the rest of
+	invalid atomic.Int64
+	// Refused by Matomo with a 4xx status
+	rejected atomic.Int64
+	// In batches Matomo took without telling how many hits it tracked
+	unknown atomic.Int64
+	// Not sent when the agent stopped, or could not be spooled
+	failed atomic.Int64
+}
+
+var delivered deliveryCounts
+
+// Log the counts
+func (c *deliveryCounts) report() {
+	logger.Infof("Hits tracked: %d, invalid: %d, rejected: %d, unknown: %d, failed: %d",
+		c.tracked.Load(), c.invalid.Load(), c.rejected.Load(), c.unknown.Load(), c.failed.Load())
+}
+
+// A record in the dead-letter file, for a line that could not be parsed
+// or a hit Matomo rejected
+type deadLetter struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	// Path of the log, for lines that could not be parsed
+	Log string `json:"log,omitempty"`
+	// The raw log line
+	Line string `json:"line,omitempty"`
+	// Header lines the line is parsed with, like the W3C #Fields directive
+	Header []string `json:"header,omitempty"`
+	// Query string of the tracking request, without token_auth
+	Request string `json:"request,omitempty"`
+}
+
+// The dead-letter file, if agent.dead_letter_file is set
+var deadLetterFile *os.File
+var deadLetterMutex sync.Mutex
+
+// Open the dead-letter file to append to. Every agent writing to it holds a
+// shared lock on it, so replay-dlq doesn't move it aside while it is in use.
+func openDeadLetters(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	if err := lockFileShared(file); err != nil {
+		file.Close()
+		if errors.Is(err, errLocked) {
+			return fmt.Errorf("dead-letter file %s is being replayed, start the agent once replay-dlq is done", path)
+		}
+		return fmt.Errorf("failed to lock dead-letter file: %w", err)
+	}
+	deadLetterFile = file
+	return nil
+}
+
+// Requests that Matomo refused, with the log lines they were built from.
+// They are logged, written to the dead-letter file, and not sent again.
+func rejectRequests(requests []url.Values, lines []string, err error) {
+	delivered.rejected.Add(int64(len(requests)))
+	logger.Errorf("Matomo rejected %d hits: %v", len(requests), err)
+	deadLetterRequests(requests, lines, err.Error())
+}
+
+// Write requests to the dead-letter file. lines has the log line of every
+// request, or is nil if they are not known.
+func deadLetterRequests(requests []url.Values, lines []string, reason string) {
+	now := time.Now().UTC()
+	records := make([]deadLetter, len(requests))
+	for i, request := range requests {
+		request.Del("token_auth")
+		logger.Debugf("Dead-lettered hit: %s", request.Encode())
+		records[i] = deadLetter{Time: now, Reason: reason, Request: request.Encode()}
+		if i < len(lines) {
+			records[i].Line = lines[i]
+		}
+	}
+	writeDeadLetters(records)
+}
+
+// Write a log line that could not be parsed to the dead-letter file, with
+// the header lines the parser had read
+func deadLetterLine(log string, parser *logParser, line string, err error) {
+	record := deadLetter{Time: time.Now().UTC(), Reason: err.Error(), Log: log, Line: line}
+	if parser != nil {
+		record.Header = parser.headerLines()
+	}
+	writeDeadLetters([]deadLetter{record})
+}
+
+// Write records to the dead-letter file, one JSON line per record
+func writeDeadLetters(records []deadLetter) {
+	if deadLetterFile == nil {
+		return
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	// Keep the & in query strings readable
+	encoder.SetEscapeHTML(false)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			logger.Errorf("Failed to write to dead-letter file: %v", err)
+		}
+	}
+
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	if _, err := deadLetterFile.Write(buffer.Bytes()); err != nil {
+		logger.Errorf("Failed to write to dead-letter file: %v", err)
+	}
+}
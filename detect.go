@@ -0,0 +1,194 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// Number of lines to sample when detecting the log format
+const defaultDetectLines = 50
+
+// A format to try when detecting the log format, as changes to the config
+type detectCandidate struct {
+	label     string
+	configure func(config *Config)
+}
+
+// Formats to try, given the formats set in the config
+func detectCandidates(config *Config) []detectCandidate {
+	candidates := []detectCandidate{
+		{"nginx", func(c *Config) { c.Log.LogFormat = "nginx" }},
+	}
+
+	if config.Log.ApacheFormat != "" {
+		candidates = append(candidates, detectCandidate{"apache", func(c *Config) { c.Log.LogFormat = "apache" }})
+	} else {
+		for _, nickname := range []string{"common", "vhost_combined"} {
+			nickname := nickname
+			candidates = append(candidates, detectCandidate{"apache " + nickname, func(c *Config) {
+				c.Log.LogFormat = "apache"
+				c.Log.ApacheFormat = nickname
+			}})
+		}
+	}
+
+	for _, format := range []string{"json", "caddy", "cloudflare", "alb", "cloudfront", "w3c", "haproxy"} {
+		format := format
+		candidates = append(candidates, detectCandidate{format, func(c *Config) { c.Log.LogFormat = format }})
+	}
+
+	return append(candidates,
+		detectCandidate{"csv", func(c *Config) {
+			c.Log.LogFormat = "csv"
+			c.Log.CSV.Header = false
+		}},
+		detectCandidate{"csv with header", func(c *Config) {
+			c.Log.LogFormat = "csv"
+			c.Log.CSV.Header = true
+		}},
+		detectCandidate{"tsv with header", func(c *Config) {
+			c.Log.LogFormat = "tsv"
+			c.Log.CSV.Header = true
+		}},
+	)
+}
+
+// Detect the format of the log in log_path by parsing the first lines with
+// every known format. The format that parses most lines, and gets the most
+// out of them, is used. If two formats are equally good, the format is
+// ambiguous and has to be set in the config.
+func detectLogParser(config *Config) (*logParser, error) {
+	// Lines sampled from a pipe can't be read again
+	if isPipe(config.Log.LogPath) {
+		return nil, &formatError{fmt.Errorf("can't detect the log format of a pipe, set log_format in the config")}
+	}
+
+	lines, err := sampleLogLines(config.Log.LogPath, config.Log.DetectLines)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s is empty, can't detect the log format", config.Log.LogPath)
+	}
+
+	type result struct {
+		label  string
+		config Config
+		parsed int
+		score  int
+	}
+
+	var best []result
+	for _, candidate := range detectCandidates(config) {
+		candidateConfig := *config
+		candidate.configure(&candidateConfig)
+		parser, err := newLogParser(&candidateConfig)
+		if err != nil {
+			logger.Debugf("Can't try log format %s: %v", candidate.label, err)
+			continue
+		}
+
+		r := result{label: candidate.label, config: candidateConfig}
+		requests := 0
+		for _, line := range lines {
+			logData, err := parser.lineFormat.parse(line)
+			if err == errSkipLine {
+				continue
+			}
+			requests++
+			if err != nil || logData.URL == "" {
+				continue
+			}
+			r.parsed++
+			r.score += detectScore(logData)
+		}
+		logger.Debugf("Log format %s parsed %d of %d lines, score %d", candidate.label, r.parsed, requests, r.score)
+
+		// Most lines should be parsed for the format to be a match
+		if r.parsed == 0 || r.parsed*2 <= requests {
+			continue
+		}
+
+		switch {
+		case len(best) == 0 || r.parsed > best[0].parsed || (r.parsed == best[0].parsed && r.score > best[0].score):
+			best = []result{r}
+		case r.parsed == best[0].parsed && r.score == best[0].score:
+			best = append(best, r)
+		}
+	}
+
+	if len(best) == 0 {
+		return nil, &formatError{fmt.Errorf("no known log format matches %s, set log_format in the config", config.Log.LogPath)}
+	}
+	if len(best) > 1 {
+		labels := make([]string, len(best))
+		for i, r := range best {
+			labels[i] = r.label
+		}
+		return nil, &formatError{fmt.Errorf("log format of %s is ambiguous, it could be %s; set log_format in the config", config.Log.LogPath, strings.Join(labels, " or "))}
+	}
+
+	logger.Infof("Detected log format %s for %s, from %d sampled lines", best[0].label, config.Log.LogPath, len(lines))
+	config.Log = best[0].config.Log
+
+	return newLogParser(config)
+}
+
+// Score how much a format got out of a line, one point per field with a
+// value and one for a valid timestamp.
+func detectScore(logData *LogData) int {
+	score := 0
+	for _, value := range []string{logData.IP, logData.Host, logData.Method, logData.URL, logData.Status, logData.Size, logData.Referrer, logData.UserAgent} {
+		if value != "" {
+			score++
+		}
+	}
+	if _, err := parseTime(logData.Timestamp); err == nil {
+		score++
+	}
+	return score
+}
+
+// Read the first lines of a log
+func sampleLogLines(path string, count int) ([]string, error) {
+	if count <= 0 {
+		count = defaultDetectLines
+	}
+
+	file, err := openLogReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for len(lines) < count && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading log file: %v", err)
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,427 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// How often to check a followed file in poll mode, if not configured
+	defaultPollInterval = 250 * time.Millisecond
+	// How often to check a followed file when watching it for changes,
+	// in case a change is missed
+	watchPollInterval = 2 * time.Second
+	// How long a rotated file must have been without new lines before
+	// switching to the new file
+	rotateGrace = 5 * time.Second
+)
+
+// Which file a followed line was read from
+type fileID struct {
+	Device      uint64
+	Inode       uint64
+	Fingerprint string
+}
+
+// A line read from a followed file, with the offset just after it
+type followedLine struct {
+	Text   string
+	Offset int64
+	File   fileID
+}
+
+// How to follow a file
+type followOptions struct {
+	// Poll for changes instead of watching with inotify, for file systems
+	// like NFS where changes are not notified
+	Poll         bool
+	PollInterval time.Duration
+}
+
+// A follower reads a file like tail -F, and knows the byte offset of
+// every line it reads, so reading can be resumed after a restart. When the
+// file is rotated by renaming, the old file is read to the end before
+// switching to the new file. When it is truncated, like by logrotate's
+// copytruncate, reading starts over from the start of the file. When it is
+// removed, and no new file is created, the follower stops once the old file
+// has been read to the end.
+type follower struct {
+	path    string
+	options followOptions
+
+	file   *os.File
+	info   os.FileInfo
+	id     fileID
+	reader *bufio.Reader
+	offset int64
+	// A line without newline at the end of the file is still being written
+	partial string
+
+	Lines chan followedLine
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// Start following the file at path from offset. If the file doesn't exist
+// yet, the follower waits for it.
+func followFile(path string, offset int64, options followOptions) (*follower, error) {
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultPollInterval
+	}
+
+	f := &follower{
+		path:    path,
+		options: options,
+		Lines:   make(chan followedLine),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := f.open(offset); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		logger.Infof("Waiting for %s to be created", path)
+	}
+	go f.run()
+
+	return f, nil
+}
+
+// Stop following, Lines is closed when the follower has stopped. Lines is
+// also closed when the followed file has been removed.
+func (f *follower) Stop() {
+	close(f.stop)
+	<-f.done
+}
+
+// Open the file at path and seek to offset
+func (f *follower) open(offset int64) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if offset > info.Size() {
+		logger.Infof("%s is shorter than offset %d, reading from the start", f.path, offset)
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek to %d: %w", offset, err)
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	f.info = info
+	f.reader = bufio.NewReader(file)
+	f.offset = offset
+	f.partial = ""
+	f.id = fileID{}
+	f.id.Device, f.id.Inode = fileIdentity(info)
+	f.id.Fingerprint = readFingerprint(file)
+
+	return nil
+}
+
+func (f *follower) run() {
+	defer close(f.done)
+	defer close(f.Lines)
+	defer func() {
+		if f.file != nil {
+			f.file.Close()
+		}
+	}()
+
+	wake, closeWatcher := f.watch()
+	defer closeWatcher()
+
+	interval := f.options.PollInterval
+	if wake != nil {
+		interval = watchPollInterval
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	// When the file at path has been replaced, and since when the old
+	// file has had no new lines
+	var rotatedSince time.Time
+	// Since when the file at path has been missing, and the old file has
+	// had no new lines
+	var missingSince time.Time
+
+	for {
+		// Check for truncation before reading, so lines written to the
+		// truncated file are not read from the old offset
+		change := f.checkFile()
+		if change == fileTruncated {
+			logger.Infof("%s has been truncated, reading from the start", f.path)
+			if err := f.open(0); err != nil {
+				logger.Errorf("Failed to reopen %s: %v", f.path, err)
+			}
+		}
+
+		if f.file != nil {
+			read, ok := f.readLines()
+			if !ok {
+				return
+			}
+			if read {
+				rotatedSince = time.Time{}
+				missingSince = time.Time{}
+			}
+		}
+
+		// A removed file, like an old log removed by logrotate, is let go
+		// so its disk space is freed. Without an old file, the follower
+		// waits for the file to be created.
+		if change != fileMissing {
+			missingSince = time.Time{}
+		} else if f.file != nil {
+			if missingSince.IsZero() {
+				missingSince = time.Now()
+			} else if time.Since(missingSince) >= rotateGrace {
+				logger.Infof("%s has been removed, stopping following it", f.path)
+				return
+			}
+		}
+
+		if change == fileReplaced {
+			if f.file != nil && rotatedSince.IsZero() {
+				rotatedSince = time.Now()
+			}
+			// Read what is left in the rotated file before switching
+			if f.file == nil || time.Since(rotatedSince) >= rotateGrace {
+				if f.file != nil {
+					logger.Infof("%s has been rotated, following the new file", f.path)
+				}
+				if err := f.open(0); err != nil {
+					logger.Errorf("Failed to open %s: %v", f.path, err)
+				}
+				rotatedSince = time.Time{}
+				continue
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(interval)
+		select {
+		case <-timer.C:
+		case <-wake:
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// Read and send the lines up to the end of the file. Returns if any lines
+// were read, and false for ok when the follower is stopped.
+func (f *follower) readLines() (read bool, ok bool) {
+	for {
+		text, err := f.reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				logger.Errorf("Error reading %s: %v", f.path, err)
+			}
+			f.partial += text
+			f.offset += int64(len(text))
+			return read || text != "", true
+		}
+
+		raw := f.partial + text
+		f.offset += int64(len(text))
+		f.partial = ""
+		if f.id.Fingerprint == "" && f.offset == int64(len(raw)) {
+			f.id.Fingerprint = lineFingerprint(raw)
+		}
+
+		line := followedLine{
+			Text:   strings.TrimRight(raw, "\r\n"),
+			Offset: f.offset,
+			File:   f.id,
+		}
+		select {
+		case f.Lines <- line:
+			read = true
+		case <-f.stop:
+			return read, false
+		}
+	}
+}
+
+// Changes to the followed file, found by checkFile
+const (
+	fileUnchanged = iota
+	fileMissing
+	fileReplaced
+	fileTruncated
+)
+
+// Check if the file at path is still the open file, and if it has been
+// truncated. A file that is truncated and written again past the read
+// offset before this check is found by its changed first line.
+func (f *follower) checkFile() int {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fileMissing
+	}
+	if f.file == nil || !os.SameFile(info, f.info) {
+		return fileReplaced
+	}
+	if info.Size() < f.offset {
+		return fileTruncated
+	}
+	if f.id.Fingerprint != "" && readFingerprint(f.file) != f.id.Fingerprint {
+		return fileTruncated
+	}
+	return fileUnchanged
+}
+
+// Watch the directory of the file for changes, unless in poll mode. The
+// returned channel gets a value for changes to the file, it is nil if
+// the file isn't watched.
+func (f *follower) watch() (<-chan struct{}, func()) {
+	if f.options.Poll {
+		return nil, func() {}
+	}
+
+	wake, unwatch, err := watchPath(f.path)
+	if err != nil {
+		logger.Warnf("Failed to watch %s, polling for changes: %v", f.path, err)
+		return nil, func() {}
+	}
+	return wake, unwatch
+}
+
+// A dirWatcher watches a directory for the followers of files in it. Every
+// watcher is an inotify instance, and there are only 128 of them per user
+// by default, so the followers in a directory share one.
+type dirWatcher struct {
+	dir     string
+	watcher *fsnotify.Watcher
+	// The channels to wake followers with, and the path they follow
+	wakes map[chan struct{}]string
+}
+
+var dirWatchers = make(map[string]*dirWatcher)
+var dirWatchersMutex sync.Mutex
+
+// Watch path for changes. The returned channel gets a value for changes to
+// the file, until the returned function is called.
+func watchPath(path string) (<-chan struct{}, func(), error) {
+	path = filepath.Clean(path)
+	dir := filepath.Dir(path)
+
+	dirWatchersMutex.Lock()
+	defer dirWatchersMutex.Unlock()
+
+	w := dirWatchers[dir]
+	if w == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, nil, err
+		}
+		w = &dirWatcher{dir: dir, watcher: watcher, wakes: make(map[chan struct{}]string)}
+		dirWatchers[dir] = w
+		go w.run()
+	}
+
+	wake := make(chan struct{}, 1)
+	w.wakes[wake] = path
+	unwatch := func() {
+		dirWatchersMutex.Lock()
+		delete(w.wakes, wake)
+		last := len(w.wakes) == 0 && dirWatchers[dir] == w
+		if last {
+			delete(dirWatchers, dir)
+		}
+		dirWatchersMutex.Unlock()
+
+		// The last follower in the directory stops the watcher
+		if last {
+			w.watcher.Close()
+		}
+	}
+	return wake, unwatch, nil
+}
+
+// Wake the followers of the files that changed, until the watcher is closed
+func (w *dirWatcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Clean(event.Name)
+			dirWatchersMutex.Lock()
+			for wake, path := range w.wakes {
+				if path != name {
+					continue
+				}
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+			dirWatchersMutex.Unlock()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warnf("Error watching %s: %v", w.dir, err)
+		}
+	}
+}
+
+// Fingerprint of the first line of an open file, empty if it has no full
+// line yet.
+func readFingerprint(file *os.File) string {
+	line, err := bufio.NewReader(io.NewSectionReader(file, 0, 1<<20)).ReadString('\n')
+	if err != nil {
+		return ""
+	}
+	return lineFingerprint(line)
+}
@@ -0,0 +1,237 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testPollOptions = followOptions{Poll: true, PollInterval: 10 * time.Millisecond}
+
+func appendTestLog(t *testing.T, path string, text string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startFollowing(t *testing.T, path string, offset int64, options followOptions) *follower {
+	t.Helper()
+	f, err := followFile(path, offset, options)
+	if err != nil {
+		t.Fatalf("followFile: %v", err)
+	}
+	t.Cleanup(f.Stop)
+	return f
+}
+
+// The next line the follower reads, within timeout
+func nextLine(t *testing.T, f *follower, timeout time.Duration) followedLine {
+	t.Helper()
+	select {
+	case line, ok := <-f.Lines:
+		if !ok {
+			t.Fatal("follower stopped")
+		}
+		return line
+	case <-time.After(timeout):
+		t.Fatalf("no line read from %s within %s", f.path, timeout)
+	}
+	return followedLine{}
+}
+
+func expectLine(t *testing.T, f *follower, text string, offset int64) followedLine {
+	t.Helper()
+	line := nextLine(t, f, time.Second)
+	if line.Text != text || line.Offset != offset {
+		t.Fatalf("read %q at %d, want %q at %d", line.Text, line.Offset, text, offset)
+	}
+	return line
+}
+
+func TestFollowFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendTestLog(t, path, "first\nsecond\n")
+	f := startFollowing(t, path, 0, testPollOptions)
+
+	first := expectLine(t, f, "first", 6)
+	expectLine(t, f, "second", 13)
+
+	// A line is only read once it is complete
+	appendTestLog(t, path, "thi")
+	select {
+	case line := <-f.Lines:
+		t.Fatalf("read %q before the line was complete", line.Text)
+	case <-time.After(100 * time.Millisecond):
+	}
+	appendTestLog(t, path, "rd\r\n")
+	third := expectLine(t, f, "third", 20)
+	if third.File != first.File || first.File.Inode == 0 || first.File.Fingerprint == "" {
+		t.Errorf("file of the lines %+v and %+v, want the same file", first.File, third.File)
+	}
+}
+
+func TestFollowFileFromOffset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendTestLog(t, path, "first\nsecond\n")
+	f := startFollowing(t, path, 6, testPollOptions)
+	expectLine(t, f, "second", 13)
+
+	// An offset past the end, of a file that was replaced while the agent
+	// was down, reads the file from the start
+	short := startFollowing(t, path, 1000, testPollOptions)
+	expectLine(t, short, "first", 6)
+}
+
+func TestFollowFileCreated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f := startFollowing(t, path, 0, testPollOptions)
+
+	appendTestLog(t, path, "first\n")
+	expectLine(t, f, "first", 6)
+}
+
+func TestFollowTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendTestLog(t, path, "first line\nsecond line\n")
+	f := startFollowing(t, path, 0, testPollOptions)
+	expectLine(t, f, "first line", 11)
+	expectLine(t, f, "second line", 23)
+
+	// copytruncate, and a shorter line written
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendTestLog(t, path, "new\n")
+	expectLine(t, f, "new", 4)
+}
+
+func TestFollowTruncatedAndWrittenPast(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendTestLog(t, path, "first\n")
+	f := startFollowing(t, path, 0, testPollOptions)
+	expectLine(t, f, "first", 6)
+
+	// Truncated and written past the read offset before the follower
+	// looks, it is noticed by the changed first line
+	if err := os.WriteFile(path, []byte("rewritten\nlines\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expectLine(t, f, "rewritten", 10)
+	expectLine(t, f, "lines", 16)
+}
+
+func TestFollowRotated(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	appendTestLog(t, path, "old\n")
+	f := startFollowing(t, path, 0, testPollOptions)
+	first := expectLine(t, f, "old", 4)
+
+	// Renamed, and the server writes to the old file until it reopens the
+	// log
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendTestLog(t, path, "new\n")
+	appendTestLog(t, path+".1", "late\n")
+	expectLine(t, f, "late", 9)
+
+	// The new file is read once the old one had no new lines for a while
+	line := nextLine(t, f, rotateGrace+2*time.Second)
+	if line.Text != "new" || line.Offset != 4 || line.File == first.File {
+		t.Errorf("read %q at %d of %+v, want new at 4 of the new file", line.Text, line.Offset, line.File)
+	}
+}
+
+func TestFollowRemoved(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendTestLog(t, path, "first\n")
+	f := startFollowing(t, path, 0, testPollOptions)
+	expectLine(t, f, "first", 6)
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line, ok := <-f.Lines:
+		if ok {
+			t.Fatalf("read %q from a removed file", line.Text)
+		}
+	case <-time.After(rotateGrace + 2*time.Second):
+		t.Fatal("still following a removed file")
+	}
+}
+
+func TestFollowWatch(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")}
+	var followers []*follower
+	for _, path := range paths {
+		appendTestLog(t, path, "")
+		f, err := followFile(path, 0, followOptions{})
+		if err != nil {
+			t.Fatalf("followFile: %v", err)
+		}
+		followers = append(followers, f)
+	}
+
+	// Changes are noticed right away, not with the 2s poll
+	time.Sleep(100 * time.Millisecond)
+	for i, path := range paths {
+		appendTestLog(t, path, "line\n")
+		line := nextLine(t, followers[i], watchPollInterval/2)
+		if line.Text != "line" {
+			t.Errorf("read %q from %s", line.Text, path)
+		}
+	}
+
+	// The followers in a directory share a watcher
+	dirWatchersMutex.Lock()
+	w := dirWatchers[dir]
+	watched := 0
+	if w != nil {
+		watched = len(w.wakes)
+	}
+	dirWatchersMutex.Unlock()
+	if watched != 2 {
+		t.Errorf("%d followers on the watcher of %s, want 2", watched, dir)
+	}
+
+	for _, f := range followers {
+		f.Stop()
+	}
+	dirWatchersMutex.Lock()
+	_, ok := dirWatchers[dir]
+	dirWatchersMutex.Unlock()
+	if ok {
+		t.Error("watcher still open after all followers stopped")
+	}
+}
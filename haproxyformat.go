@@ -0,0 +1,130 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAProxy "option httplog" format, after the syslog prefix.
+//
+// Example: Feb  6 12:14:14 localhost haproxy[14389]: 10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {1wt.eu} {} "GET /index.html HTTP/1.1"
+var haproxyPattern = regexp.MustCompile(`(\S+):(\d+) \[([^\]]+)\] (\S+) ([^/\s]+)/(\S+) (-?\d+)/(-?\d+)/(-?\d+)/(-?\d+)/\+?(-?\d+) (\d+) \+?(\d+) \S+ \S+ (\S+) \d+/\d+/\d+/\d+/\+?\d+ \d+/\d+(?: (\{[^}]*\}))?(?: (\{[^}]*\}))? "([^"]*)"`)
+
+// Names of the HAProxy timers, in log order
+var haproxyTimers = []string{"Tq", "Tw", "Tc", "Tr", "Tt"}
+
+// A haproxyFormat parses HAProxy HTTP logs. Captured request headers are
+// named by log.haproxy_captures, in the order of the capture statements.
+type haproxyFormat struct {
+	captures []string
+}
+
+func (f *haproxyFormat) parse(line string) (*LogData, error) {
+	match := haproxyPattern.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("line does not match the HAProxy HTTP log format")
+	}
+
+	logData := &LogData{
+		IP:     match[1],
+		Status: match[12],
+		Size:   match[13],
+		Fields: map[string]string{
+			"client_port":       match[2],
+			"frontend_name":     match[4],
+			"backend_name":      match[5],
+			"server_name":       match[6],
+			"termination_state": match[14],
+		},
+	}
+
+	// The accept date is local time with milliseconds, like 06/Feb/2009:12:14:14.655
+	acceptDate, err := time.ParseInLocation("02/Jan/2006:15:04:05.000", match[3], time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("invalid accept date: %w", err)
+	}
+	logData.Timestamp = acceptDate.Format(time.RFC3339Nano)
+
+	// Timers are in milliseconds, -1 if the step was never reached
+	for i, timer := range haproxyTimers {
+		logData.Fields[timer] = match[7+i]
+	}
+	if total, err := strconv.Atoi(match[11]); err == nil && total >= 0 {
+		logData.Duration = time.Duration(total) * time.Millisecond
+	}
+
+	// A frontend name ending with ~ is an SSL/TLS listener
+	logData.Scheme = "http"
+	if strings.HasSuffix(match[4], "~") {
+		logData.Scheme = "https"
+	}
+
+	// Captured headers are in braces, first the request headers and then
+	// the response headers. With only one of them, it is taken as the
+	// request headers.
+	captured := strings.Trim(match[15], "{}")
+	if len(f.captures) > 0 {
+		for i, value := range strings.Split(captured, "|") {
+			if i >= len(f.captures) {
+				break
+			}
+			logData.setField("http_"+headerVariableName(f.captures[i]), unescapeHAProxyValue(value))
+		}
+	} else if captured != "" {
+		logData.Fields["captured_request_headers"] = captured
+	}
+	if responseCaptured := strings.Trim(match[16], "{}"); responseCaptured != "" {
+		logData.Fields["captured_response_headers"] = responseCaptured
+	}
+
+	request := match[17]
+	if request == "<BADREQ>" {
+		return nil, fmt.Errorf("bad request")
+	}
+	logData.setField("request", request)
+
+	return logData, nil
+}
+
+// HAProxy logs some characters in captured headers as #XX, like #22 for a
+// quote.
+func unescapeHAProxyValue(value string) string {
+	if !strings.Contains(value, "#") {
+		return value
+	}
+
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '#' && i+2 < len(value) {
+			if b, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				unescaped.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		unescaped.WriteByte(value[i])
+	}
+	return unescaped.String()
+}
@@ -0,0 +1,143 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The config of every input, with the input's settings in place of the
+// global ones. Without [[input]] blocks, the [log] settings are the only
+// input.
+func (config *Config) inputConfigs() ([]*Config, error) {
+	if len(config.Inputs) == 0 {
+		if config.Log.LogPath == "" {
+			return nil, fmt.Errorf("no log to tail, set log.log_path or add [[input]] blocks")
+		}
+		return []*Config{config}, nil
+	}
+
+	var configs []*Config
+	for i, input := range config.Inputs {
+		if input.Path == "" {
+			return nil, fmt.Errorf("input %d has no path", i+1)
+		}
+		if _, err := filepath.Match(input.Path, ""); err != nil {
+			return nil, fmt.Errorf("input %d has an invalid path %q: %w", i+1, input.Path, err)
+		}
+		configs = append(configs, config.withInput(input))
+	}
+	return configs, nil
+}
+
+// Copy of the config with the settings of an input
+func (config *Config) withInput(input InputConfig) *Config {
+	c := *config
+	c.Inputs = nil
+	c.Log.LogPath = input.Path
+
+	if input.LogFormat != "" {
+		c.Log.LogFormat = input.LogFormat
+	}
+	if input.NginxFormat != "" {
+		c.Log.NginxFormat = input.NginxFormat
+	}
+	if input.ApacheFormat != "" {
+		c.Log.ApacheFormat = input.ApacheFormat
+	}
+	if input.JSONFields != nil {
+		c.Log.JSONFields = input.JSONFields
+	}
+	if input.HAProxyCaptures != nil {
+		c.Log.HAProxyCaptures = input.HAProxyCaptures
+	}
+	if input.CSV.Delimiter != "" {
+		c.Log.CSV.Delimiter = input.CSV.Delimiter
+	}
+	if input.CSV.Header != nil {
+		c.Log.CSV.Header = *input.CSV.Header
+	}
+	if input.CSV.LazyQuotes != nil {
+		c.Log.CSV.LazyQuotes = *input.CSV.LazyQuotes
+	}
+	if input.CSV.Columns != nil {
+		c.Log.CSV.Columns = input.CSV.Columns
+	}
+	// Polling can only be turned on, so --poll applies to all inputs
+	if input.Poll {
+		c.Log.Poll = true
+	}
+	if input.PollInterval > 0 {
+		c.Log.PollInterval = input.PollInterval
+	}
+	if input.SiteID != "" {
+		c.Matomo.SiteID = input.SiteID
+	}
+	if input.WebSite != "" {
+		c.Matomo.WebSite = input.WebSite
+	}
+	if input.UserAgents != nil {
+		c.Log.UserAgents = input.UserAgents
+	}
+	if input.ExcludedURLs != nil {
+		c.Log.ExcludedURLs = input.ExcludedURLs
+	}
+	if input.CollectTitles != nil {
+		c.Title.Collect = *input.CollectTitles
+	}
+	if input.TitleDomain != "" {
+		c.Title.Domain = input.TitleDomain
+	}
+
+	return &c
+}
+
+// Copy of an input config for one of the files matching its path
+func (config *Config) withLogPath(path string) *Config {
+	c := *config
+	c.Log.LogPath = path
+	return &c
+}
+
+// If a path has glob patterns, like /var/log/nginx/*.access.log
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// The files currently matching the path of an input. A path without glob
+// patterns is returned as is, even if the file doesn't exist yet.
+func inputPaths(config *Config) []string {
+	if !isGlob(config.Log.LogPath) {
+		return []string{config.Log.LogPath}
+	}
+
+	// The pattern has been checked when loading the inputs
+	matches, _ := filepath.Glob(config.Log.LogPath)
+	var paths []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && !info.IsDir() {
+			paths = append(paths, match)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,123 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The dates hits have been sent to Matomo for, per site, so their archived
+// reports can be invalidated after a backfill
+var (
+	sentDates      = make(map[string]map[string]bool)
+	sentDatesMutex sync.Mutex
+)
+
+// Record that a hit has been sent for a site, at cdt, like 2024-10-23 12:19:08
+func recordSentDate(siteID, cdt string) {
+	if len(cdt) < len("2006-01-02") {
+		return
+	}
+
+	sentDatesMutex.Lock()
+	defer sentDatesMutex.Unlock()
+
+	if sentDates[siteID] == nil {
+		sentDates[siteID] = make(map[string]bool)
+	}
+	sentDates[siteID][cdt[:len("2006-01-02")]] = true
+}
+
+// Invalidate the archived reports of the sites and dates hits have been sent
+// for, with CoreAdminHome.invalidateArchivedReports, so Matomo archives the
+// imported hits when it archives next. The token needs admin access to the
+// sites.
+func invalidateArchivedReports(config *Config) error {
+	sentDatesMutex.Lock()
+	defer sentDatesMutex.Unlock()
+
+	siteIDs := make([]string, 0, len(sentDates))
+	for siteID := range sentDates {
+		siteIDs = append(siteIDs, siteID)
+	}
+	sort.Strings(siteIDs)
+
+	for _, siteID := range siteIDs {
+		dates := make([]string, 0, len(sentDates[siteID]))
+		for date := range sentDates[siteID] {
+			dates = append(dates, date)
+		}
+		sort.Strings(dates)
+
+		if err := invalidateSiteReports(config, siteID, dates); err != nil {
+			return fmt.Errorf("failed to invalidate reports of site %s: %w", siteID, err)
+		}
+		logger.Infof("Invalidated archived reports of site %s for %d day(s), %s to %s", siteID, len(dates), dates[0], dates[len(dates)-1])
+		delete(sentDates, siteID)
+	}
+
+	return nil
+}
+
+func invalidateSiteReports(config *Config, siteID string, dates []string) error {
+	data := url.Values{
+		"module":     {"API"},
+		"method":     {"CoreAdminHome.invalidateArchivedReports"},
+		"format":     {"JSON"},
+		"idSites":    {siteID},
+		"dates":      {strings.Join(dates, ",")},
+		"token_auth": {config.Matomo.TokenAuth},
+	}
+	apiURL := fmt.Sprintf("%sindex.php", config.Matomo.URL)
+
+	resp, err := matomoClient.PostForm(apiURL, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response: %v", err)
+	}
+
+	// Errors come back as {"result": "error", "message": "..."}
+	var result struct {
+		Result  string `json:"result"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &result) == nil && result.Result == "error" {
+		return fmt.Errorf("%s", result.Message)
+	}
+	logger.Debugf("Invalidated archived reports of site %s: %s", siteID, body)
+
+	return nil
+}
@@ -0,0 +1,148 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A jsonFormat parses access logs with one JSON object per line.
+type jsonFormat struct {
+	// LogData field name to dotted key path, like "url" = "request.uri"
+	fields map[string]string
+}
+
+func newJSONFormat(fields map[string]string) (*jsonFormat, error) {
+	for name := range fields {
+		if logDataFieldVariables[name] == "" {
+			return nil, fmt.Errorf("unknown field %q in log.json_fields", name)
+		}
+	}
+	return &jsonFormat{fields: fields}, nil
+}
+
+// Parse a JSON log line. Keys not in log.json_fields are used as log format
+// variables, so nginx escape=json logs with keys named like the variables
+// need no mapping.
+func (f *jsonFormat) parse(line string) (*LogData, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	values := make(map[string]string)
+	flattenJSON("", object, values)
+
+	mapped := make(map[string]bool)
+	for _, path := range f.fields {
+		mapped[path] = true
+	}
+
+	// Set the unmapped keys in a stable order, so Fields doesn't depend
+	// on map iteration
+	paths := make([]string, 0, len(values))
+	for path := range values {
+		if !mapped[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	logData := &LogData{}
+	for _, path := range paths {
+		logData.setField(path, values[path])
+	}
+	for name, path := range f.fields {
+		value, ok := values[path]
+		if !ok {
+			continue
+		}
+		variable := logDataFieldVariables[name]
+		if name == "timestamp" && isJSONNumber(object, path) {
+			// Seconds since the epoch
+			variable = "msec"
+		}
+		logData.setField(variable, value)
+	}
+
+	return logData, nil
+}
+
+// Flatten nested objects into dotted key paths. Arrays of values, like
+// headers in some logs, are joined with commas.
+func flattenJSON(prefix string, value interface{}, values map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range v {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			flattenJSON(path, nested, values)
+		}
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, jsonValueString(item))
+		}
+		values[prefix] = strings.Join(parts, ", ")
+	default:
+		values[prefix] = jsonValueString(v)
+	}
+}
+
+func jsonValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// Check if the value at a dotted key path is a number
+func isJSONNumber(object map[string]interface{}, path string) bool {
+	var value interface{} = object
+	for _, key := range strings.Split(path, ".") {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		value = nested[key]
+	}
+	_, ok := value.(json.Number)
+	return ok
+}
@@ -20,68 +20,174 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
-	"time"
+	"syscall"
 )
 
-// Function to simulate cat command with rate-limiting
-func catLogFile(config *Config, requestsPerSec int) error {
-	file, err := os.Open(config.Log.LogPath)
+// Function to simulate cat command with rate-limiting. The log path can be
+// a directory or a glob of logs, read oldest first, and compressed logs are
+// decompressed. Stdin and named pipes are read until they are closed. With
+// merge, the lines of all logs are sent in timestamp order instead. The
+// pacer sets when the lines are sent, at a fixed rate or replayed. With a
+// state file, the offset of the last line sent of every log is saved, and
+// with resume, logs are read from there.
+func catLogFile(config *Config, pace pacer, merge bool, resume bool) error {
+	inputs, err := config.inputConfigs()
 	if err != nil {
-		return fmt.Errorf("failed to open log file: %v", err)
+		return err
 	}
-	defer file.Close()
+	defer pace.stop()
 
-	// Calculate the delay between requests based on the configured rate
-	delay := time.Second / time.Duration(requestsPerSec)
+	if resume && config.Agent.StateFile == "" {
+		return fmt.Errorf("resuming needs a state file, set agent.state_file or --state-file")
+	}
+	checkpoints, err := loadCheckpoints(config.Agent.StateFile, importCheckpoints)
+	if err != nil {
+		return fmt.Errorf("failed to load checkpoints: %v", err)
+	}
+	stopCheckpoints := make(chan struct{})
+	checkpointsSaved := make(chan struct{})
+	go func() {
+		checkpoints.run(stopCheckpoints)
+		close(checkpointsSaved)
+	}()
 
-	// Create a ticker to control the request rate
-	ticker := time.NewTicker(delay)
-	defer ticker.Stop()
+	var logs []*Config
+	for _, input := range inputs {
+		paths, err := catLogPaths(input.Log.LogPath)
+		if err != nil {
+			return fmt.Errorf("failed to find log files: %v", err)
+		}
+		if len(paths) == 0 {
+			logger.Warnf("No log files found for %s", input.Log.LogPath)
+		}
+		for _, path := range paths {
+			logs = append(logs, input.withLogPath(path))
+		}
+	}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
+	run := &catRun{
+		checkpoints: checkpoints,
+		resume:      resume,
+		progress:    newProgress(logs, config.Agent.LogFile != ""),
+		stopped:     make(chan struct{}),
+	}
+	stopProgress := make(chan struct{})
+	go run.progress.run(stopProgress)
 
-		// Parse the log line
-		logData := parseLog(line, config.Log.LogFormat)
-		if logData == nil {
-			logger.Warnf("Failed to parse log line: %s", line)
-			continue
-		}
+	// Stop on SIGINT or SIGTERM, and save the checkpoints of the hits that
+	// have been sent, so the import can be resumed
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Infof("Received %s, stopping", sig)
+		stopDelivery()
+		close(run.stopped)
+	}()
 
-		// Wait for the next tick to respect the rate limit
-		<-ticker.C
+	if merge {
+		err = catLogsMerged(logs, pace, run)
+	} else {
+		for _, logConfig := range logs {
+			if err = catLog(logConfig, pace, run); err != nil || run.isStopped() {
+				break
+			}
+		}
+	}
 
-		// Send the parsed log to Matomo
-		sendToMatomo(logData, config)
+	// Send what is left in the batch
+	if config.Batch.Mode {
+		flushBatch(config)
+	}
+	// Hits still in the spool are delivered the next time the agent starts,
+	// but the import is only done once Matomo has all of them
+	stopSpool(true, run.stopped)
+	close(stopProgress)
+	run.progress.report()
+	delivered.report()
+	close(stopCheckpoints)
+	<-checkpointsSaved
+	if err != nil {
+		return err
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading log file: %v", err)
+	// Have Matomo archive the sent hits, which are in the past
+	if config.Matomo.InvalidateReports {
+		if err := invalidateArchivedReports(config); err != nil {
+			logger.Errorf("Failed to invalidate archived reports: %v", err)
+		}
 	}
 
+	if run.isStopped() {
+		logger.Info("Stopped processing log file in catlog mode, use --resume to continue")
+		return nil
+	}
 	logger.Info("Finished processing log file in catlog mode")
 	return nil
 }
 
+// Send the lines of one log, when the pacer has them due
+func catLog(config *Config, pace pacer, run *catRun) error {
+	reader, err := openCatReader(config, run)
+	if err != nil {
+		return err
+	}
+	defer reader.close()
+
+	logger.Infof("Reading %s", config.Log.LogPath)
+	for !run.isStopped() {
+		logData, ack, err := reader.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading log file %s: %v", config.Log.LogPath, err)
+		}
+
+		// Wait for the line to be due, to respect the rate limit
+		if !pace.wait(logData, run.stopped) {
+			return nil
+		}
+
+		// Send the parsed log to Matomo
+		sendToMatomo(logData, config, ack)
+		run.progress.sent()
+	}
+	return nil
+}
+
 func main() {
+	// Subcommands come before the flags
+	if len(os.Args) > 1 && os.Args[1] == "replay-dlq" {
+		replayDeadLetters(os.Args[2:])
+		return
+	}
+
 	// Define flags
 
 	configPath := flag.String("config", "/opt/log-agent/config.toml", "Path to the configuration file")
 	catLog := flag.Bool("catlog", false, "Simulate cat command for a log file")
 	reqPerSec := flag.Int("rps", 1, "Requests per second limit for catlog mode")
+	since := flag.String("since", "", "Only send lines from this time on, like 2024-10-23 12:00:00")
+	until := flag.String("until", "", "Only send lines up to this time, like 2024-10-23 14:00:00")
+	replay := flag.Bool("replay", false, "Replay the log in catlog mode with the original time between the lines")
+	replaySpeed := flag.Float64("speed", 1, "Speed factor for replay mode, like 10 to replay 10 times faster")
+	replayNow := flag.Bool("replay-now", false, "Set the timestamps of replayed lines to the time they are sent")
+	resume := flag.Bool("resume", false, "Resume catlog mode where it stopped last time, from the state file")
+	mergeLogs := flag.Bool("merge", false, "Merge the lines of all logs in timestamp order in catlog mode")
 	matomoURL := flag.String("matomo-url", "", "Matomo URL")
 	tokenAuth := flag.String("token-auth", "", "Matomo token auth")
 	siteID := flag.String("site-id", "", "Matomo site ID")
 	pluginEnabled := flag.Bool("plugin", false, "If using the Matomo Agent plugin")
+	invalidate := flag.Bool("invalidate", false, "Invalidate the archived reports of the dates sent in catlog mode")
 	downloadsEnabled := flag.Bool("downloads", true, "Enable download tracking")
-	logFormat := flag.String("log-format", "", "Log format (nginx, apache or csv)")
+	logFormat := flag.String("log-format", "", "Log format (nginx, apache, json, caddy, cloudflare, alb, cloudfront, w3c, haproxy or csv)")
 	logPath := flag.String("log-path", "", "Path to the log file")
 	userAgents := flag.String("user-agents", "", "Comma-separated list of user agents to track (Overrides config file)")
 	agentLogLevel := flag.String("log-level", "", "Log level (debug, info, warn, error) (Overrides config file)")
@@ -89,8 +195,18 @@ func main() {
 	isTitleEnabled := flag.Bool("collect-title", false, "Enable collection of page titles based on URL")
 	titleDomain := flag.String("title-domain", "", "Override default domain to fetch title from")
 	batchMode := flag.Bool("batch", false, "Enable batch mode for sending logs")
+	pollMode := flag.Bool("poll", false, "Poll the log file for changes instead of using inotify, like for NFS")
+	deadLetterPath := flag.String("dead-letter-file", "", "Path to the file to write rejected hits and unparsable lines to (Overrides config file)")
+	rejectLogPath := flag.String("reject-log", "", "Same as --dead-letter-file")
+	spoolDir := flag.String("spool-dir", "", "Directory to spool hits in while Matomo can't be reached (Overrides config file)")
+	stateFile := flag.String("state-file", "", "Path to the file to keep read positions in (Overrides config file)")
 
 	// Parse the flags first
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [log paths, or - for stdin]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s replay-dlq [flags] [dead-letter file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// Load the config file
@@ -113,11 +229,27 @@ func main() {
 	if *downloadsEnabled {
 		config.Matomo.Downloads = *downloadsEnabled
 	}
+	if *invalidate {
+		config.Matomo.InvalidateReports = true
+	}
 	if *logFormat != "" {
 		config.Log.LogFormat = *logFormat
 	}
 	if *logPath != "" {
+		// Tail only this log, with the [log] settings
 		config.Log.LogPath = *logPath
+		config.Inputs = nil
+	}
+	if flag.NArg() == 1 {
+		// Like --log-path, "-" reads the log from stdin
+		config.Log.LogPath = flag.Arg(0)
+		config.Inputs = nil
+	} else if flag.NArg() > 1 {
+		// Every log is an input with the [log] settings
+		config.Inputs = nil
+		for _, path := range flag.Args() {
+			config.Inputs = append(config.Inputs, InputConfig{Path: path})
+		}
 	}
 	if *userAgents != "" {
 		config.Log.UserAgents = strings.Split(*userAgents, ",")
@@ -141,22 +273,54 @@ func main() {
 		config.Batch.Mode = *batchMode
 	}
 
-	// Override config with flag values
-	//overrideConfigWithFlags(config)
+	if *since != "" {
+		if config.Window.Since, err = parseWindowTime(*since); err != nil {
+			log.Fatalf("Invalid --since: %v", err)
+		}
+	}
+	if *until != "" {
+		if config.Window.Until, err = parseWindowTime(*until); err != nil {
+			log.Fatalf("Invalid --until: %v", err)
+		}
+	}
 
-	// Set up logging (call once after flags and config are processed)
-	setupLogging(config.Agent.LogLevel, config.Agent.LogFile)
+	if *pollMode {
+		config.Log.Poll = *pollMode
+	}
 
-	// Validate Matomo token
-	err = validateTokenAuth(config)
-	if err != nil {
-		logger.Fatal("Invalid Matomo token:", err)
+	if *stateFile != "" {
+		config.Agent.StateFile = *stateFile
+	}
+
+	if *deadLetterPath != "" {
+		config.Agent.DeadLetterFile = *deadLetterPath
+	} else if *rejectLogPath != "" {
+		config.Agent.DeadLetterFile = *rejectLogPath
 	}
 
-	// Check if catlog mode is enabled
-	if *catLog {
-		logger.Infof("Starting in catlog mode, sending %d requests per second", *reqPerSec)
-		err = catLogFile(config, *reqPerSec)
+	if *spoolDir != "" {
+		config.Spool.Dir = *spoolDir
+	}
+
+	// Override config with flag values
+	//overrideConfigWithFlags(config)
+
+	setupAgent(config)
+
+	// Check if catlog mode is enabled, replay is catlog with the original timing
+	if *catLog || *replay {
+		var pace pacer
+		if *replay {
+			logger.Infof("Starting in replay mode, at %g times the original speed", *replaySpeed)
+			pace, err = newReplayPacer(*replaySpeed, *replayNow)
+		} else {
+			logger.Infof("Starting in catlog mode, sending %d requests per second", *reqPerSec)
+			pace, err = newRatePacer(*reqPerSec)
+		}
+		if err != nil {
+			logger.Fatalf("Error in catlog mode: %v", err)
+		}
+		err = catLogFile(config, pace, *mergeLogs, *resume)
 		if err != nil {
 			logger.Fatalf("Error in catlog mode: %v", err)
 		}
@@ -166,3 +330,41 @@ func main() {
 		tailLogFile(config)
 	}
 }
+
+// Set up logging, check the Matomo token, and open the dead-letter file and
+// the spool, once the flags and config are processed
+func setupAgent(config *Config) {
+	setupLogging(config.Agent.LogLevel, config.Agent.LogFile)
+
+	// Every input gets a copy of the config, so make sure the Matomo URLs
+	// end with a '/' before copying, as batches are sent with any of them
+	InitializeAgentURL(config)
+	if !strings.HasSuffix(config.Matomo.TrackerURL, "/") {
+		config.Matomo.TrackerURL += "/"
+	}
+
+	matomoClient.Timeout = config.Retry.RequestTimeout
+
+	// Validate Matomo token
+	if err := validateTokenAuth(config); err != nil {
+		logger.Fatal("Invalid Matomo token:", err)
+	}
+
+	if config.Agent.DeadLetterFile != "" {
+		if err := openDeadLetters(config.Agent.DeadLetterFile); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	// Hits are spooled on disk, and delivered from there
+	if config.Spool.Dir != "" {
+		if err := startSpool(config); err != nil {
+			logger.Fatalf("Failed to open spool: %v", err)
+		}
+	}
+
+	// Spooled hits are sent in batches by the spool
+	if config.Batch.Mode && hitSpool == nil {
+		go runBatchFlusher(config)
+	}
+}
@@ -19,10 +19,11 @@
 package main
 
 import (
-	"encoding/csv"
-	"io"
-	"regexp"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Struct of log data.
@@ -30,6 +31,7 @@ type LogData struct {
 	IP        string
 	Timestamp string
 	Host      string
+	Scheme    string
 	Method    string
 	URL       string
 	Protocol  string
@@ -37,77 +39,237 @@ type LogData struct {
 	Size      string
 	Referrer  string
 	UserAgent string
+	User      string
+	Duration  time.Duration
 	Hour      string
 	Minute    string
 	Second    string
+	// Variables from a custom log format that have no field of their own,
+	// keyed by variable name.
+	Fields map[string]string
+	// The log line, for the dead-letter file
+	Line string
 }
 
-// Parse log line for Nginx, Apache, or CSV.
-func parseLog(line, logFormat string) *LogData {
-	var logPattern *regexp.Regexp
-	var logData *LogData
-
-	// Nginx and Apache log formats (same regex for both)
-	if logFormat == "nginx" || logFormat == "apache" {
-		logPattern = regexp.MustCompile(`(?P<ip>\S+) - - \[(?P<time>[^\]]+)\] "(?P<method>\S+) (?P<url>\S+) (?P<protocol>\S+)" (?P<status>\d+) (?P<size>\d+) "(?P<referrer>[^"]*)" "(?P<user_agent>[^"]*)"`)
-	} else if logFormat == "csv" {
-		// CSV log format: timestamp, req_method, final_host, req_uri, resp_status, client_ip, req_referer, req_user_agent
-
-		// Example: 2024-09-10 18:13:19 UTC,GET,example.org,/news/2024/09/09/south-sudan-parliament-approves-transitional-justice-laws,200,2.86.73.63,https://my.url/,Mozilla/5.0...
-		reader := csv.NewReader(strings.NewReader(line))
-		reader.TrimLeadingSpace = true // In case there are extra spaces
-
-		// Read one record (log line)
-		record, err := reader.Read()
-		if err == io.EOF {
-			return nil // End of input
-		} else if err != nil {
-			logger.Warnf("Failed to parse CSV log line: %s", err)
-			return nil
+// Names of the LogData fields in field mappings, like log.json_fields, and
+// the log format variable setting each of them
+var logDataFieldVariables = map[string]string{
+	"ip":           "remote_addr",
+	"timestamp":    "time_local",
+	"host":         "host",
+	"scheme":       "scheme",
+	"method":       "request_method",
+	"url":          "request_uri",
+	"protocol":     "server_protocol",
+	"request":      "request",
+	"status":       "status",
+	"size":         "body_bytes_sent",
+	"referrer":     "http_referer",
+	"user_agent":   "http_user_agent",
+	"user":         "remote_user",
+	"request_time": "request_time",
+}
+
+// Set a log format variable on the log data. Variables are named as in
+// nginx, known ones fill LogData fields and the rest end up in Fields.
+func (logData *LogData) setField(name, value string) {
+	// nginx and Apache log "-" for empty values
+	if value == "-" {
+		value = ""
+	}
+
+	switch name {
+	case "remote_addr":
+		logData.IP = value
+	case "remote_user":
+		logData.User = value
+	case "time_local", "time_iso8601":
+		logData.Timestamp = value
+	case "msec":
+		// Seconds since the epoch, with millisecond resolution
+		logData.Timestamp = epochTimestamp(value, time.Second)
+	case "time_msec":
+		logData.Timestamp = epochTimestamp(value, time.Millisecond)
+	case "time_usec":
+		logData.Timestamp = epochTimestamp(value, time.Microsecond)
+	case "request":
+		// The request line, like "GET /index.html HTTP/1.1"
+		parts := strings.Fields(value)
+		if len(parts) > 0 {
+			logData.Method = parts[0]
 		}
-		if len(record) < 8 {
-			logger.Warn("Invalid CSV log format")
-			return nil
+		if len(parts) > 1 {
+			logData.URL = parts[1]
 		}
-
-		logData = &LogData{
-			Timestamp: record[0],
-			Method:    record[1],
-			Host:      record[2],
-			URL:       record[3],
-			Status:    record[4],
-			IP:        record[5],
-			Referrer:  record[5],
-			UserAgent: record[7],
+		if len(parts) > 2 {
+			logData.Protocol = parts[2]
 		}
-	} else {
-		logger.Warn("Unknown log format")
+	case "request_method":
+		logData.Method = value
+	case "request_uri":
+		logData.URL = value
+	case "uri":
+		if logData.URL == "" {
+			logData.URL = value
+		}
+	case "server_protocol":
+		logData.Protocol = value
+	case "status":
+		logData.Status = value
+	case "body_bytes_sent":
+		logData.Size = value
+	case "bytes_sent":
+		if logData.Size == "" {
+			logData.Size = value
+		}
+	case "http_referer":
+		logData.Referrer = value
+	case "http_user_agent":
+		logData.UserAgent = value
+	case "host":
+		logData.Host = value
+	case "http_host", "server_name":
+		if logData.Host == "" {
+			logData.Host = value
+		}
+	case "scheme":
+		logData.Scheme = value
+	case "request_time":
+		// Seconds with millisecond resolution, like 0.123
+		logData.Duration = parseDuration(value, time.Second)
+	case "request_time_ms":
+		logData.Duration = parseDuration(value, time.Millisecond)
+	case "request_time_us":
+		logData.Duration = parseDuration(value, time.Microsecond)
+	default:
+		if logData.Fields == nil {
+			logData.Fields = make(map[string]string)
+		}
+		logData.Fields[name] = value
+	}
+}
 
-		return nil
+// Parse a number of units, like 0.123 seconds, as a duration
+func parseDuration(value string, unit time.Duration) time.Duration {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
 	}
+	return time.Duration(number * float64(unit))
+}
 
-	if logFormat == "nginx" || logFormat == "apache" {
-		// Match the Nginx/Apache log format
-		match := logPattern.FindStringSubmatch(line)
-		if match != nil {
-			logData = &LogData{
-				IP:        match[1],
-				Timestamp: match[2],
-				Method:    match[3],
-				URL:       match[4],
-				Protocol:  match[5],
-				Status:    match[6],
-				Size:      match[7],
-				Referrer:  match[8],
-				UserAgent: match[9],
-			}
-		} else {
-			return nil
+// Returned by parsers for lines without a request, like header lines and
+// directives, that should be skipped without a warning.
+var errSkipLine = errors.New("line has no request")
+
+// An error in the log format settings, or a log format that can't be
+// detected. Reading the log again won't fix it.
+type formatError struct {
+	err error
+}
+
+func (e *formatError) Error() string { return e.err.Error() }
+func (e *formatError) Unwrap() error { return e.err }
+
+// A lineFormat parses single log lines of one format.
+type lineFormat interface {
+	parse(line string) (*LogData, error)
+}
+
+// A lineFormat that keeps state from header lines, like the CSV header or
+// the W3C #Fields directive, tells the header lines it has read, so a line
+// can be parsed again later with the same header.
+type headerFormat interface {
+	headerLines() []string
+}
+
+// A logParser parses the lines of a log in one configured format.
+type logParser struct {
+	format     string
+	lineFormat lineFormat
+}
+
+// Create a parser for the log format in the config. For nginx a custom
+// log_format can be given with log.nginx_format and for Apache a LogFormat
+// with log.apache_format, otherwise the combined format is used. Without a
+// log format, or with "auto", the format is detected from the log.
+func newLogParser(config *Config) (*logParser, error) {
+	parser := &logParser{format: config.Log.LogFormat}
+
+	switch config.Log.LogFormat {
+	case "", "auto":
+		return detectLogParser(config)
+	case "nginx":
+		format := nginxCombinedFormat
+		if config.Log.NginxFormat != "" {
+			format = config.Log.NginxFormat
+		}
+		pattern, err := compileNginxFormat(format)
+		if err != nil {
+			return nil, &formatError{fmt.Errorf("invalid nginx log format: %w", err)}
+		}
+		parser.lineFormat = pattern
+	case "apache":
+		format := "combined"
+		if config.Log.ApacheFormat != "" {
+			format = config.Log.ApacheFormat
+		}
+		pattern, err := compileApacheFormat(format)
+		if err != nil {
+			return nil, &formatError{fmt.Errorf("invalid Apache log format: %w", err)}
+		}
+		parser.lineFormat = pattern
+	case "json":
+		format, err := newJSONFormat(config.Log.JSONFields)
+		if err != nil {
+			return nil, &formatError{err}
+		}
+		parser.lineFormat = format
+	case "caddy":
+		parser.lineFormat = caddyFormat{}
+	case "cloudflare":
+		parser.lineFormat = cloudflareFormat{}
+	case "alb":
+		parser.lineFormat = albFormat{}
+	case "cloudfront":
+		parser.lineFormat = newCloudFrontFormat()
+	case "w3c", "iis":
+		parser.lineFormat = newW3CFormat()
+	case "haproxy":
+		parser.lineFormat = &haproxyFormat{captures: config.Log.HAProxyCaptures}
+	case "csv", "tsv":
+		format, err := newCSVFormat(config)
+		if err != nil {
+			return nil, &formatError{fmt.Errorf("invalid CSV log format: %w", err)}
 		}
+		parser.lineFormat = format
+	default:
+		return nil, &formatError{fmt.Errorf("unknown log format %q", config.Log.LogFormat)}
+	}
+
+	return parser, nil
+}
+
+// The header lines the parser has read, if its format has them
+func (p *logParser) headerLines() []string {
+	if format, ok := p.lineFormat.(headerFormat); ok {
+		return format.headerLines()
+	}
+	return nil
+}
+
+// Parse log line for Nginx, Apache, JSON, Caddy, Cloudflare, AWS, W3C,
+// HAProxy or CSV. Lines without a request return errSkipLine. Some formats,
+// like W3C, keep state from earlier lines, so every log needs its own parser.
+func (p *logParser) parseLog(line string) (*LogData, error) {
+	logData, err := p.lineFormat.parse(line)
+	if err != nil {
+		return nil, err
 	}
+	logData.Line = line
 
 	// Parse the timestamp and extract hour, minute, second
-	if logData != nil && logData.Timestamp != "" {
+	if logData.Timestamp != "" {
 		h, m, s, err := parseTimestamp(logData.Timestamp)
 		if err != nil {
 			logger.Warnf("Error parsing timestamp: %v", err)
@@ -118,5 +280,5 @@ func parseLog(line, logFormat string) *LogData {
 		}
 	}
 
-	return logData
+	return logData, nil
 }
@@ -0,0 +1,363 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sample lines of every log format. The lines before the last are header
+// lines, that are skipped, and the last is the request.
+var parserTests = []struct {
+	name   string
+	format string
+	setup  func(config *Config)
+	lines  []string
+	want   LogData
+	fields map[string]string
+}{
+	{
+		name:   "nginx combined",
+		format: "nginx",
+		lines:  []string{`203.0.113.7 - alice [23/Oct/2024:12:19:08 +0200] "GET /blog/?p=1 HTTP/1.1" 200 5120 "https://example.com/" "Mozilla/5.0 (X11; Linux x86_64)"`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "23/Oct/2024:12:19:08 +0200", Method: "GET", URL: "/blog/?p=1", Protocol: "HTTP/1.1",
+			Status: "200", Size: "5120", Referrer: "https://example.com/", UserAgent: "Mozilla/5.0 (X11; Linux x86_64)", User: "alice"},
+	},
+	{
+		name:   "nginx custom format",
+		format: "nginx",
+		setup: func(config *Config) {
+			config.Log.NginxFormat = `$remote_addr [$time_local] $host "$request" $status $request_time "$http_user_agent" $http_x_forwarded_for`
+		},
+		lines: []string{`203.0.113.7 [23/Oct/2024:12:19:08 +0200] example.com "GET /a HTTP/2.0" 200 0.250 "Mozilla/5.0" 198.51.100.1`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "23/Oct/2024:12:19:08 +0200", Host: "example.com", Method: "GET", URL: "/a", Protocol: "HTTP/2.0",
+			Status: "200", UserAgent: "Mozilla/5.0", Duration: 250 * time.Millisecond},
+		fields: map[string]string{"http_x_forwarded_for": "198.51.100.1"},
+	},
+	{
+		name:   "apache combined",
+		format: "apache",
+		lines:  []string{`203.0.113.7 - - [23/Oct/2024:12:19:08 +0200] "POST /login HTTP/1.1" 302 0 "-" "curl/8.0"`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "23/Oct/2024:12:19:08 +0200", Method: "POST", URL: "/login", Protocol: "HTTP/1.1",
+			Status: "302", Size: "0", UserAgent: "curl/8.0"},
+	},
+	{
+		name:   "apache vhost_combined",
+		format: "apache",
+		setup:  func(config *Config) { config.Log.ApacheFormat = "vhost_combined" },
+		lines:  []string{`example.com:443 203.0.113.7 - - [23/Oct/2024:12:19:08 +0200] "GET / HTTP/1.1" 200 512 "https://example.org/" "Mozilla/5.0"`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "23/Oct/2024:12:19:08 +0200", Host: "example.com", Method: "GET", URL: "/", Protocol: "HTTP/1.1",
+			Status: "200", Size: "512", Referrer: "https://example.org/", UserAgent: "Mozilla/5.0"},
+	},
+	{
+		name:   "apache custom time with spaces",
+		format: "apache",
+		setup:  func(config *Config) { config.Log.ApacheFormat = `%h %{%Y-%m-%d %H:%M:%S %z}t "%r" %>s %b` },
+		lines:  []string{`203.0.113.7 2024-10-23 12:19:08 +0200 "GET /a HTTP/1.1" 200 512`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T12:19:08+02:00", Method: "GET", URL: "/a", Protocol: "HTTP/1.1",
+			Status: "200", Size: "512"},
+	},
+	{
+		name:   "json",
+		format: "json",
+		lines:  []string{`{"time_iso8601":"2024-10-23T12:19:08+02:00","remote_addr":"203.0.113.7","request":"GET /shop?id=3 HTTP/2.0","status":404,"body_bytes_sent":12,"http_referer":"","http_user_agent":"Mozilla/5.0","host":"example.com"}`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T12:19:08+02:00", Host: "example.com", Method: "GET", URL: "/shop?id=3", Protocol: "HTTP/2.0",
+			Status: "404", Size: "12", UserAgent: "Mozilla/5.0"},
+	},
+	{
+		name:   "json with mapped fields",
+		format: "json",
+		setup: func(config *Config) {
+			config.Log.JSONFields = map[string]string{
+				"ip": "client.ip", "timestamp": "ts", "method": "request.method", "url": "request.uri",
+				"status": "status", "user_agent": "request.headers.User-Agent",
+			}
+		},
+		lines:  []string{`{"ts":"2024-10-23T10:19:08Z","client":{"ip":"203.0.113.7"},"request":{"method":"GET","uri":"/api","headers":{"User-Agent":"curl/8.0"}},"status":200,"app":"shop"}`},
+		want:   LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08Z", Method: "GET", URL: "/api", Status: "200", UserAgent: "curl/8.0"},
+		fields: map[string]string{"app": "shop"},
+	},
+	{
+		name:   "caddy",
+		format: "caddy",
+		lines:  []string{`{"level":"info","ts":1729678748.5,"logger":"http.log.access","msg":"handled request","request":{"remote_ip":"203.0.113.7","remote_port":"51234","proto":"HTTP/2.0","method":"GET","host":"example.com","uri":"/docs/","headers":{"User-Agent":["Mozilla/5.0"],"Referer":["https://example.org/"]},"tls":{"resumed":false}},"user_id":"","duration":0.012,"size":2048,"status":200}`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08.5Z", Host: "example.com", Scheme: "https", Method: "GET", URL: "/docs/", Protocol: "HTTP/2.0",
+			Status: "200", Size: "2048", Referrer: "https://example.org/", UserAgent: "Mozilla/5.0", Duration: 12 * time.Millisecond},
+	},
+	{
+		name:   "cloudflare",
+		format: "cloudflare",
+		lines:  []string{`{"ClientIP":"203.0.113.7","ClientRequestHost":"example.com","ClientRequestMethod":"GET","ClientRequestURI":"/pricing","ClientRequestProtocol":"HTTP/2","ClientRequestScheme":"https","ClientRequestReferer":"https://www.google.com/","ClientRequestUserAgent":"Mozilla/5.0","EdgeResponseStatus":200,"EdgeResponseBytes":3000,"EdgeStartTimestamp":"2024-10-23T10:19:08Z","EdgeEndTimestamp":"2024-10-23T10:19:08.2Z","RayID":"8d6c1d2e3f4a5b6c"}`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08Z", Host: "example.com", Scheme: "https", Method: "GET", URL: "/pricing", Protocol: "HTTP/2",
+			Status: "200", Size: "3000", Referrer: "https://www.google.com/", UserAgent: "Mozilla/5.0", Duration: 200 * time.Millisecond},
+		fields: map[string]string{"RayID": "8d6c1d2e3f4a5b6c"},
+	},
+	{
+		name:   "alb",
+		format: "alb",
+		lines:  []string{`https 2024-10-23T10:19:08.123456Z app/my-lb/50dc6c495c0c9188 203.0.113.7:51234 10.0.0.1:80 0.001 0.020 0.000 200 200 34 366 "GET https://example.com:443/cart?item=2 HTTP/1.1" "Mozilla/5.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "example.com" "arn:aws:acm:eu-west-1:123456789012:certificate/abc" 0 2024-10-23T10:19:08.100000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-"`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08.123456Z", Host: "example.com", Scheme: "https", Method: "GET", URL: "/cart?item=2", Protocol: "HTTP/1.1",
+			Status: "200", Size: "366", UserAgent: "Mozilla/5.0", Duration: 21 * time.Millisecond},
+	},
+	{
+		name:   "cloudfront",
+		format: "cloudfront",
+		lines: []string{
+			"#Version: 1.0",
+			"#Fields: date time x-edge-location sc-bytes c-ip cs-method cs(Host) cs-uri-stem sc-status cs(Referer) cs(User-Agent) cs-uri-query cs(Cookie) x-edge-result-type x-edge-request-id x-host-header cs-protocol cs-bytes time-taken",
+			"2024-10-23\t10:19:08\tARN1-C1\t1200\t203.0.113.7\tGET\td111111abcdef8.cloudfront.net\t/index.html\t200\thttps://example.org/\tMozilla/5.0%20(X11)\tq=1\t-\tHit\tabc==\texample.com\thttps\t150\t0.002",
+		},
+		want: LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08Z", Host: "example.com", Scheme: "https", Method: "GET", URL: "/index.html?q=1",
+			Status: "200", Size: "1200", Referrer: "https://example.org/", UserAgent: "Mozilla/5.0 (X11)", Duration: 2 * time.Millisecond},
+		fields: map[string]string{"x-edge-location": "ARN1-C1"},
+	},
+	{
+		name:   "w3c",
+		format: "w3c",
+		lines: []string{
+			"#Software: Microsoft Internet Information Services 10.0",
+			"#Fields: date time s-ip cs-method cs-uri-stem cs-uri-query s-port cs-username c-ip cs(User-Agent) cs(Referer) sc-status sc-substatus sc-win32-status time-taken",
+			"2024-10-23 10:19:08 10.0.0.1 GET /default.aspx id=5 443 - 203.0.113.7 Mozilla/5.0+(Windows+NT+10.0) https://example.org/ 200 0 0 15",
+		},
+		want: LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08Z", Scheme: "https", Method: "GET", URL: "/default.aspx?id=5",
+			Status: "200", Referrer: "https://example.org/", UserAgent: "Mozilla/5.0 (Windows NT 10.0)", Duration: 15 * time.Millisecond},
+		fields: map[string]string{"s-ip": "10.0.0.1"},
+	},
+	{
+		name:   "w3c with #Date",
+		format: "w3c",
+		lines: []string{
+			"#Date: 2024-10-23 00:00:00",
+			"#Fields: time c-ip cs-method cs-uri-stem sc-status",
+			"10:19:08 203.0.113.7 GET /a 200",
+		},
+		want: LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08Z", Method: "GET", URL: "/a", Status: "200"},
+	},
+	{
+		name:   "haproxy",
+		format: "haproxy",
+		setup:  func(config *Config) { config.Log.HAProxyCaptures = []string{"Host", "User-Agent", "Referer"} },
+		lines:  []string{`Oct 23 12:19:08 lb haproxy[1234]: 203.0.113.7:51234 [23/Oct/2024:12:19:08.123] www~ web/srv1 0/0/1/10/11 200 2048 - - ---- 1/1/0/0/0 0/0 {example.com|Mozilla/5.0|https://example.org/} "GET /about HTTP/1.1"`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T12:19:08.123Z", Host: "example.com", Scheme: "https", Method: "GET", URL: "/about", Protocol: "HTTP/1.1",
+			Status: "200", Size: "2048", Referrer: "https://example.org/", UserAgent: "Mozilla/5.0", Duration: 11 * time.Millisecond},
+		fields: map[string]string{"backend_name": "web", "server_name": "srv1", "Tr": "10"},
+	},
+	{
+		name:   "csv",
+		format: "csv",
+		lines:  []string{`2024-10-23T10:19:08Z,GET,example.com,/a,200,203.0.113.7,https://example.org/,Mozilla/5.0`},
+		want: LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08Z", Host: "example.com", Method: "GET", URL: "/a",
+			Status: "200", Referrer: "https://example.org/", UserAgent: "Mozilla/5.0"},
+	},
+	{
+		name:   "csv with header",
+		format: "csv",
+		setup:  func(config *Config) { config.Log.CSV.Header = true },
+		lines:  []string{"timestamp,ip,url,status,user_agent,colo", "2024-10-23T10:19:08Z,203.0.113.7,/h,200,Mozilla/5.0,AMS"},
+		want:   LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08Z", URL: "/h", Status: "200", UserAgent: "Mozilla/5.0"},
+		fields: map[string]string{"colo": "AMS"},
+	},
+	{
+		name:   "csv with header and named columns",
+		format: "csv",
+		setup: func(config *Config) {
+			config.Log.CSV.Header = true
+			config.Log.CSV.Delimiter = ";"
+			config.Log.CSV.Columns = map[string]string{
+				"timestamp": "EdgeStartTimestamp", "ip": "ClientIP", "url": "ClientRequestURI", "status": "EdgeResponseStatus", "user_agent": "4",
+			}
+		},
+		lines: []string{"EdgeStartTimestamp;ClientIP;ClientRequestURI;EdgeResponseStatus;UA", "2024-10-23T10:19:08Z; 203.0.113.7;/n;200;curl/8.0"},
+		want:  LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08Z", URL: "/n", Status: "200", UserAgent: "curl/8.0"},
+	},
+	{
+		name:   "tsv with empty columns",
+		format: "tsv",
+		lines:  []string{"2024-10-23T10:19:08Z\tGET\t\t/a\t200\t203.0.113.7\t\tMozilla/5.0"},
+		want:   LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08Z", Method: "GET", URL: "/a", Status: "200", UserAgent: "Mozilla/5.0"},
+	},
+	{
+		name:   "tsv with header and empty columns",
+		format: "tsv",
+		setup:  func(config *Config) { config.Log.CSV.Header = true },
+		lines:  []string{"timestamp\tip\turl\tstatus\treferrer\tuser_agent", "2024-10-23T10:19:08Z\t203.0.113.7\t/t\t200\t\tMozilla/5.0"},
+		want:   LogData{IP: "203.0.113.7", Timestamp: "2024-10-23T10:19:08Z", URL: "/t", Status: "200", UserAgent: "Mozilla/5.0"},
+	},
+}
+
+func TestParseLog(t *testing.T) {
+	for _, test := range parserTests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{}
+			config.Log.LogFormat = test.format
+			if test.setup != nil {
+				test.setup(config)
+			}
+			parser, err := newLogParser(config)
+			if err != nil {
+				t.Fatalf("newLogParser: %v", err)
+			}
+
+			last := len(test.lines) - 1
+			for _, line := range test.lines[:last] {
+				if _, err := parser.parseLog(line); err != errSkipLine {
+					t.Fatalf("header line %q: got %v, want errSkipLine", line, err)
+				}
+			}
+			got, err := parser.parseLog(test.lines[last])
+			if err != nil {
+				t.Fatalf("parseLog: %v", err)
+			}
+
+			for name, value := range test.fields {
+				if got.Fields[name] != value {
+					t.Errorf("field %s = %q, want %q", name, got.Fields[name], value)
+				}
+			}
+			if got.Line != test.lines[last] {
+				t.Errorf("Line = %q, want the parsed line", got.Line)
+			}
+			// Only compare the fields of the request
+			got.Fields, got.Line = nil, ""
+			got.Hour, got.Minute, got.Second = "", "", ""
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("got  %+v\nwant %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseLogErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		setup  func(config *Config)
+		line   string
+	}{
+		{"nginx garbage", "nginx", nil, "not a log line"},
+		{"apache truncated", "apache", nil, `203.0.113.7 - - [23/Oct/2024:12:19:08 +0200] "GET / HTTP/1.1" 200`},
+		{"json not an object", "json", nil, `["GET", "/"]`},
+		{"w3c without #Fields", "w3c", nil, "2024-10-23 10:19:08 GET /a 200"},
+		{"csv too few columns", "csv", nil, "2024-10-23T10:19:08Z,GET"},
+		{"csv header without known columns", "csv", func(config *Config) { config.Log.CSV.Header = true }, "a,b,c"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{}
+			config.Log.LogFormat = test.format
+			if test.setup != nil {
+				test.setup(config)
+			}
+			parser, err := newLogParser(config)
+			if err != nil {
+				t.Fatalf("newLogParser: %v", err)
+			}
+			if logData, err := parser.parseLog(test.line); err == nil || err == errSkipLine {
+				t.Errorf("got %+v, %v, want an error", logData, err)
+			}
+		})
+	}
+}
+
+// The CSV header comes again when logs are concatenated
+func TestParseLogRepeatedCSVHeader(t *testing.T) {
+	config := &Config{}
+	config.Log.LogFormat = "csv"
+	config.Log.CSV.Header = true
+	parser, err := newLogParser(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := "timestamp,ip,url,status"
+	for _, line := range []string{header, "2024-10-23T10:19:08Z,203.0.113.7,/1,200", header, "2024-10-23T10:19:09Z,203.0.113.7,/2,200"} {
+		_, err := parser.parseLog(line)
+		if line == header {
+			if err != errSkipLine {
+				t.Errorf("header: got %v, want errSkipLine", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", line, err)
+		}
+	}
+	if got := parser.headerLines(); len(got) != 1 || got[0] != header {
+		t.Errorf("headerLines = %q, want the header", got)
+	}
+}
+
+func TestDetectLogFormat(t *testing.T) {
+	samples := make(map[string][]string)
+	for _, test := range parserTests {
+		samples[test.name] = test.lines
+	}
+
+	tests := []struct {
+		sample string
+		want   string
+	}{
+		{"nginx combined", "nginx"},
+		// The Apache combined format is the nginx one
+		{"apache combined", "nginx"},
+		{"apache vhost_combined", "apache"},
+		{"json", "json"},
+		{"caddy", "caddy"},
+		{"cloudflare", "cloudflare"},
+		{"alb", "alb"},
+		{"cloudfront", "cloudfront"},
+		{"w3c", "w3c"},
+		{"w3c with #Date", "w3c"},
+		{"haproxy", "haproxy"},
+		{"csv", "csv"},
+		{"csv with header", "csv"},
+		{"tsv with header and empty columns", "tsv"},
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		t.Run(test.sample, func(t *testing.T) {
+			// The request line twice, so most lines are requests
+			lines := samples[test.sample]
+			lines = append(append([]string{}, lines...), lines[len(lines)-1])
+			path := filepath.Join(dir, strings.ReplaceAll(test.sample, " ", "_")+".log")
+			if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			config := &Config{}
+			config.Log.LogPath = path
+			config.Log.DetectLines = defaultDetectLines
+			parser, err := newLogParser(config)
+			if err != nil {
+				t.Fatalf("newLogParser: %v", err)
+			}
+			if parser.format != test.want {
+				t.Errorf("detected %s, want %s", parser.format, test.want)
+			}
+		})
+	}
+}
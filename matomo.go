@@ -21,13 +21,20 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
+// Client for all requests to Matomo. A Matomo that hangs would never fail
+// a request without a timeout, so it would not be retried either. The
+// timeout is set from retry.request_timeout.
+var matomoClient = &http.Client{Timeout: 30 * time.Second}
+
 func validateTokenAuth(config *Config) error {
 
 	data := url.Values{
@@ -38,7 +45,7 @@ func validateTokenAuth(config *Config) error {
 	}
 	validationURL := fmt.Sprintf("%sindex.php", config.Matomo.URL)
 
-	resp, err := http.PostForm(validationURL, data)
+	resp, err := matomoClient.PostForm(validationURL, data)
 	if err != nil {
 		return fmt.Errorf("error validating token: %v", err)
 	}
@@ -89,11 +96,19 @@ func contains(slice []string, item string) bool {
 	return false
 }
 
-// Matomo Tracking API call
-func sendToMatomo(logData *LogData, config *Config) {
+// Matomo Tracking API call. ack, if not nil, is called when the hit has
+// been sent, or when there is nothing to send.
+func sendToMatomo(logData *LogData, config *Config, ack func()) {
+	if ack == nil {
+		ack = func() {}
+	}
 
 	if len(logData.Host) > 0 {
-		logData.URL = "https://" + logData.Host + logData.URL
+		scheme := "https"
+		if len(logData.Scheme) > 0 {
+			scheme = logData.Scheme
+		}
+		logData.URL = scheme + "://" + logData.Host + logData.URL
 	} else {
 		logData.URL = config.Matomo.WebSite + logData.URL
 	}
@@ -104,17 +119,20 @@ func sendToMatomo(logData *LogData, config *Config) {
 
 	if len(config.Log.UserAgents) > 0 && !contains(config.Log.UserAgents, logData.UserAgent) {
 		logger.Debugf("User agent '%s' not tracked. Skipping log.", logData.UserAgent)
+		ack()
 		return
 	}
 
 	// Check if the request URL contains an ignored media file extension
 	if isIgnored(logData.URL) {
 		logger.Debugf("Skipping media file request: %s", logData.URL)
+		ack()
 		return
 	}
 
 	if !shouldSendURL(logData.URL, config.Log.ExcludedURLs) {
 		logger.Debugf("URL %s is excluded, not sending to Matomo.", logData.URL)
+		ack()
 		return
 	}
 
@@ -139,6 +157,7 @@ func sendToMatomo(logData *LogData, config *Config) {
 	formattedTime, err := formatTimestamp(logData.Timestamp)
 	if err != nil {
 		logger.Warnf("Failed to format timestamp: %v", err)
+		ack()
 		return
 	}
 	var pageTitle string
@@ -235,10 +254,19 @@ func sendToMatomo(logData *LogData, config *Config) {
 	if config.Matomo.Plugin {
 		if errorStatuses[logData.Status] {
 			targetURL = config.Matomo.AgentURL
-			resp, err := http.PostForm(targetURL, data)
-			if err != nil {
-				logger.Error("Error sending data to Matomo:", err)
+			err := deliver(config, deliveryStopped, func() error {
+				resp, err := matomoClient.PostForm(targetURL, data)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				return checkResponse(resp)
+			})
+			if isRetryable(err) {
+				// Stopped, so the line is sent again when tailing resumes
 				return
+			} else if err != nil {
+				logger.Errorf("Error log for %s not taken by the agent plugin: %v", logData.URL, err)
 			} else {
 				var Site string
 				if len(logData.Host) > 0 {
@@ -246,16 +274,14 @@ func sendToMatomo(logData *LogData, config *Config) {
 				} else {
 					Site = config.Matomo.WebSite
 				}
-				logger.Debugf("Error log sent for host %s site %s: %s, Status: %s", Site, config.Matomo.SiteID, logData.URL, resp.Status)
+				logger.Debugf("Error log sent for host %s site %s: %s", Site, config.Matomo.SiteID, logData.URL)
 			}
-			defer resp.Body.Close()
 		}
 	}
 	// Ensure the Matomo URL ends with a '/', if not, add it.
 	if !strings.HasSuffix(config.Matomo.TrackerURL, "/") {
 		config.Matomo.TrackerURL += "/"
 	}
-	targetURL = config.Matomo.TrackerURL
 
 	var batchMode bool
 	if config.Batch.Mode {
@@ -263,6 +289,7 @@ func sendToMatomo(logData *LogData, config *Config) {
 		logger.Debugf("Collect title tags from HTML")
 	}
 
+	line := logData.Line
 	if batchMode {
 
 		logData := url.Values{
@@ -276,24 +303,62 @@ func sendToMatomo(logData *LogData, config *Config) {
 			"rec":         {"1"},
 		}
 
-		addLogToBatch(logData, config)
+		sendRequest(logData, line, config, ack)
 	} else {
-		// Post to Tracker API.
-		resp, err := http.PostForm(targetURL+"matomo.php", data)
-		if err != nil {
-			logger.Error("Error sending data to Matomo:", err)
-			return
-		} else {
-			var Site string
-			if len(logData.Host) > 0 {
-				Site = logData.Host
-			} else {
-				Site = config.Matomo.WebSite
-			}
-			logger.Debugf("Log sent host %s and site %s: %s, Status: %s", Site, config.Matomo.SiteID, logData.URL, resp.Status)
+		sendRequest(data, line, config, ack)
+	}
+
+}
 
+// Send a tracking request, built from a log line, to Matomo. With a spool it
+// is queued there, in batch mode it is added to the batch, otherwise it is
+// posted to the Tracker API, and sent again until Matomo takes it. ack is
+// called once Matomo tracked the hit, or rejected it for good, so a hit that
+// was not sent when the agent stops is sent again when tailing or an import
+// resumes.
+func sendRequest(request url.Values, line string, config *Config, ack func()) {
+	if hitSpool != nil {
+		request.Del("token_auth")
+		if err := spoolHit(request, line, ack); err != nil && !errors.Is(err, errDeliveryStopped) {
+			delivered.failed.Add(1)
+			logger.Errorf("Failed to spool hit: %v", err)
 		}
-		defer resp.Body.Close()
+		return
+	}
+	if config.Batch.Mode {
+		addLogToBatch(request, line, config, ack)
+		return
+	}
+
+	err := deliver(config, deliveryStopped, func() error {
+		return postHit(request, config)
+	})
+	if isRetryable(err) {
+		// Stopped, so it is sent again when tailing or an import resumes
+		return
+	}
+	if err != nil {
+		rejectRequests([]url.Values{request}, []string{line}, err)
+	}
+	ack()
+}
+
+// Send one tracking request to the Tracker API. Returns an error if Matomo
+// could not be reached, is unavailable or rejected the request.
+func postHit(data url.Values, config *Config) error {
+	data.Set("token_auth", config.Matomo.TokenAuth)
+
+	resp, err := matomoClient.PostForm(config.Matomo.TrackerURL+"matomo.php", data)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	logger.Debugf("Hit sent, Status: %s", resp.Status)
+	delivered.tracked.Add(1)
+	recordSentDate(data.Get("idsite"), data.Get("cdt"))
+	return nil
 }
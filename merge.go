@@ -0,0 +1,140 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A log being merged, with its next parsed line
+type mergeSource struct {
+	reader *catReader
+	// Order of the log in the merge, to keep the order stable for lines
+	// with the same timestamp
+	index int
+
+	next *LogData
+	ack  func()
+	time time.Time
+}
+
+// Read the next line with a request in the time window. Returns false at
+// the end of the log, or when the log has passed the window. A line with a
+// timestamp that can't be parsed gets the timestamp of the line before it,
+// so it stays in its place in the log.
+func (s *mergeSource) advance() (bool, error) {
+	logData, ack, err := s.reader.next()
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error reading log file %s: %v", s.reader.config.Log.LogPath, err)
+	}
+
+	if parsed, err := parseTime(logData.Timestamp); err == nil {
+		s.time = parsed
+	}
+	s.next = logData
+	s.ack = ack
+	return true, nil
+}
+
+// Logs ordered by the timestamp of their next line, for container/heap
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].time.Equal(h[j].time) {
+		return h[i].index < h[j].index
+	}
+	return h[i].time.Before(h[j].time)
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	source := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return source
+}
+
+// Send the lines of several logs in timestamp order, when the pacer has
+// them due. Every log should be in timestamp order itself, like the logs of
+// the web nodes behind a load balancer, and the lines are merged like in a
+// merge sort, so visits spread over the nodes are sent hit by hit.
+func catLogsMerged(configs []*Config, pace pacer, run *catRun) error {
+	sources := &mergeHeap{}
+	defer func() {
+		for _, source := range *sources {
+			source.reader.close()
+		}
+	}()
+
+	for i, config := range configs {
+		reader, err := openCatReader(config, run)
+		if err != nil {
+			return err
+		}
+		source := &mergeSource{reader: reader, index: i}
+		ok, err := source.advance()
+		if err != nil || !ok {
+			reader.close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		heap.Push(sources, source)
+	}
+	logger.Infof("Merging %d logs by timestamp", sources.Len())
+
+	for sources.Len() > 0 && !run.isStopped() {
+		source := (*sources)[0]
+		logData := source.next
+
+		// Wait for the line to be due, to respect the rate limit
+		if !pace.wait(logData, run.stopped) {
+			break
+		}
+
+		// Send the parsed log to Matomo
+		sendToMatomo(logData, source.reader.config, source.ack)
+		run.progress.sent()
+
+		ok, err := source.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(sources, 0)
+		} else {
+			heap.Pop(sources)
+			source.reader.close()
+		}
+	}
+
+	return nil
+}
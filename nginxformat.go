@@ -0,0 +1,187 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The nginx predefined "combined" log format
+const nginxCombinedFormat = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+
+// Patterns for variables whose values can't be matched by "everything up to
+// the next literal character", like $time_local outside of brackets.
+var nginxVariablePatterns = map[string]string{
+	"time_local":   `\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`,
+	"time_iso8601": `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:Z|[+-]\d{2}:\d{2})`,
+	"status":       `\d{3}`,
+}
+
+// A logPattern is a compiled log format, a regex with one group per variable.
+type logPattern struct {
+	re     *regexp.Regexp
+	fields []string
+	// Layout of the time_custom field, from an Apache %{format}t directive
+	timeLayout string
+}
+
+// Build a logPattern from an nginx log_format string like
+// '$remote_addr - $remote_user [$time_local] "$request" ...'
+func compileNginxFormat(format string) (*logPattern, error) {
+	var literals []string
+	var fields []string
+
+	// Split the format into literal text and $variable tokens, so that
+	// literals[i] is the text before fields[i].
+	var literal strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '$' {
+			literal.WriteByte(format[i])
+			continue
+		}
+
+		var name string
+		if i+1 < len(format) && format[i+1] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated variable at position %d", i)
+			}
+			name = format[i+2 : i+end]
+			i += end
+		} else {
+			j := i + 1
+			for j < len(format) && isVariableChar(format[j]) {
+				j++
+			}
+			name = format[i+1 : j]
+			i = j - 1
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty variable name at position %d", i)
+		}
+
+		literals = append(literals, literal.String())
+		literal.Reset()
+		fields = append(fields, name)
+	}
+	literals = append(literals, literal.String())
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("log format has no variables")
+	}
+
+	return buildLogPattern(literals, fields, nginxVariablePatterns)
+}
+
+// Build the regex for a format split into literals and fields. A field
+// matches everything up to the first character of the literal after it,
+// unless it has its own pattern. Inside quotes, escaped quotes like \" are
+// part of the value.
+func buildLogPattern(literals, fields []string, patterns map[string]string) (*logPattern, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i, field := range fields {
+		expr.WriteString(regexp.QuoteMeta(literals[i]))
+
+		next := literals[i+1]
+		switch {
+		case patterns[field] != "":
+			expr.WriteString("(" + patterns[field] + ")")
+		case next == "" && i+1 == len(fields):
+			expr.WriteString("(.*)")
+		case next == "":
+			expr.WriteString("(.*?)")
+		case next[0] == '"':
+			expr.WriteString(`((?:[^"\\]|\\.)*)`)
+		default:
+			expr.WriteString("([^" + regexp.QuoteMeta(next[:1]) + "]*)")
+		}
+	}
+	expr.WriteString(regexp.QuoteMeta(literals[len(fields)]))
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile log format: %w", err)
+	}
+
+	return &logPattern{re: re, fields: fields}, nil
+}
+
+func isVariableChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// Match a line against the pattern and set each variable on a new LogData.
+func (p *logPattern) parse(line string) (*LogData, error) {
+	match := p.re.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("line does not match the log format")
+	}
+
+	logData := &LogData{}
+	for i, field := range p.fields {
+		value := match[i+1]
+		if strings.IndexByte(value, '\\') != -1 {
+			value = unescapeLogValue(value)
+		}
+		if field == "time_custom" {
+			parsedTime, err := time.ParseInLocation(p.timeLayout, value, time.Local)
+			if err != nil {
+				logger.Warnf("Error parsing timestamp: %v", err)
+				continue
+			}
+			field, value = "time_iso8601", parsedTime.Format(time.RFC3339Nano)
+		}
+		logData.setField(field, value)
+	}
+
+	return logData, nil
+}
+
+// Undo the escaping nginx and Apache do when writing values to the log,
+// like \" or \x22 for a quote.
+func unescapeLogValue(value string) string {
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			unescaped.WriteByte(value[i])
+			continue
+		}
+		switch next := value[i+1]; {
+		case next == 'x' && i+3 < len(value):
+			if b, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				unescaped.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+			unescaped.WriteByte(value[i])
+		case next == '"' || next == '\\':
+			unescaped.WriteByte(next)
+			i++
+		default:
+			unescaped.WriteByte(value[i])
+		}
+	}
+	return unescaped.String()
+}
@@ -20,19 +20,21 @@
 package main
 
 import (
-	"strings"
+	"strconv"
 	"time"
 )
 
-// Function to parse the timestamp and extract hour, minute, second
-func parseTimestamp(timestamp string) (hour, minute, second string, err error) {
-	// List of possible time formats
-	timeFormats := []string{
-		"02/Jan/2006:15:04:05 -0700", // Format like 23/Oct/2024:12:19:08 +0200
-		"2006-01-02 15:04:05 UTC",    // Format like 2024-09-10 18:13:19 UTC
-	}
+// List of possible time formats found in access logs
+var timeFormats = []string{
+	"02/Jan/2006:15:04:05 -0700", // Format like 23/Oct/2024:12:19:08 +0200
+	"2006-01-02 15:04:05 UTC",    // Format like 2024-09-10 18:13:19 UTC
+	time.RFC3339Nano,             // Format like 2024-10-23T12:19:08+02:00 (nginx $time_iso8601)
+}
 
+// Function to parse a timestamp in any of the known formats
+func parseTime(timestamp string) (time.Time, error) {
 	var parsedTime time.Time
+	var err error
 
 	// Try parsing with the different formats
 	for _, format := range timeFormats {
@@ -43,6 +45,12 @@ func parseTimestamp(timestamp string) (hour, minute, second string, err error) {
 		}
 	}
 
+	return parsedTime, err
+}
+
+// Function to parse the timestamp and extract hour, minute, second
+func parseTimestamp(timestamp string) (hour, minute, second string, err error) {
+	parsedTime, err := parseTime(timestamp)
 	if err != nil {
 		return "", "", "", err
 	}
@@ -56,19 +64,7 @@ func parseTimestamp(timestamp string) (hour, minute, second string, err error) {
 }
 
 func formatTimestamp(timestamp string) (string, error) {
-	var parsedTime time.Time
-	var err error
-
-	// Try multiple possible formats (e.g., Apache, Nginx, custom)
-	formatOne := "2006-01-02 15:04:05 UTC"
-	formatTwo := "02/Jan/2006:15:04:05 -0700"
-
-	if strings.Contains(timestamp, "UTC") {
-		parsedTime, err = time.Parse(formatOne, timestamp)
-	} else {
-		parsedTime, err = time.Parse(formatTwo, timestamp)
-	}
-
+	parsedTime, err := parseTime(timestamp)
 	if err != nil {
 		return "", err
 	}
@@ -76,3 +72,14 @@ func formatTimestamp(timestamp string) (string, error) {
 	// Format time in the required format for Matomo "YYYY-MM-DD HH:MM:SS"
 	return parsedTime.Format("2006-01-02 15:04:05"), nil
 }
+
+// Function to convert a number of units since the epoch, like the
+// 1729678748.123 of nginx $msec, to an RFC3339 timestamp
+func epochTimestamp(value string, unit time.Duration) string {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		// Leave it to parseTimestamp to report the invalid value
+		return value
+	}
+	return time.Unix(0, int64(number*float64(unit))).UTC().Format(time.RFC3339Nano)
+}
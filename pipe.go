@@ -0,0 +1,146 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// Path to read the log from stdin
+const stdinPath = "-"
+
+// If the log at path is stdin or a named pipe, which can't be followed like
+// a file
+func isPipe(path string) bool {
+	if path == stdinPath {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// Open the log at path for reading, stdin for "-"
+func openLog(path string) (*os.File, error) {
+	if path == stdinPath {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+// Start reading lines from stdin or a named pipe. Stdin is read until it is
+// closed, and then Lines is closed. A named pipe is opened again when the
+// writers have closed it, so the next writer can carry on, like nginx after
+// a reload. Offsets are counted from the start of the stream, pipes can't be
+// resumed.
+func followPipe(path string) (*follower, error) {
+	f := &follower{
+		path:  path,
+		Lines: make(chan followedLine),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	// Opening a named pipe blocks until there is a writer, so it's opened
+	// in the reading goroutine. Stdin is checked here.
+	if path == stdinPath {
+		f.file = os.Stdin
+	}
+
+	lines := make(chan string)
+	go f.readPipe(lines)
+	go f.runPipe(lines)
+
+	return f, nil
+}
+
+// Send the lines read from the pipe, until it ends or the follower is stopped
+func (f *follower) runPipe(lines <-chan string) {
+	defer close(f.done)
+	defer close(f.Lines)
+
+	for {
+		select {
+		case text, ok := <-lines:
+			if !ok {
+				logger.Infof("Reached the end of %s", f.path)
+				return
+			}
+			f.offset += int64(len(text))
+			line := followedLine{Text: strings.TrimRight(text, "\r\n"), Offset: f.offset}
+			select {
+			case f.Lines <- line:
+			case <-f.stop:
+				return
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// Read lines from the pipe. A read that is blocking on the pipe when the
+// follower is stopped is left to end with the process.
+func (f *follower) readPipe(lines chan<- string) {
+	defer close(lines)
+
+	for {
+		file := f.file
+		if file == nil {
+			var err error
+			if file, err = os.Open(f.path); err != nil {
+				logger.Errorf("Failed to open %s: %v", f.path, err)
+				return
+			}
+		}
+
+		reader := bufio.NewReader(file)
+		for {
+			text, err := reader.ReadString('\n')
+			if text != "" {
+				select {
+				case lines <- text:
+				case <-f.stop:
+					file.Close()
+					return
+				}
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				logger.Errorf("Error reading %s: %v", f.path, err)
+				break
+			}
+		}
+		file.Close()
+
+		if f.path == stdinPath {
+			return
+		}
+		select {
+		case <-f.stop:
+			return
+		default:
+			logger.Debugf("Writers closed %s, opening it again", f.path)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the progress of catlog mode is reported
+const progressInterval = 10 * time.Second
+
+// Progress of catlog mode, over all logs, by the bytes read from them
+type progress struct {
+	// Size of all logs, 0 if not known, like for stdin
+	total int64
+	// Also print the progress to stderr, when the agent logs to a file
+	console bool
+
+	mutex   sync.Mutex
+	readers []*catReader
+	// Bytes skipped at the start of the logs, like when resuming, which
+	// don't count for the rate
+	skipped int64
+
+	lines   atomic.Int64
+	started time.Time
+}
+
+// Progress of reading the logs, with the size of the logs from their config
+func newProgress(logs []*Config, console bool) *progress {
+	p := &progress{console: console, started: time.Now()}
+	for _, config := range logs {
+		if isPipe(config.Log.LogPath) {
+			p.total = 0
+			break
+		}
+		if info, err := os.Stat(config.Log.LogPath); err == nil {
+			p.total += info.Size()
+		}
+	}
+	return p
+}
+
+// Count the bytes read from a log
+func (p *progress) add(reader *catReader) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.readers = append(p.readers, reader)
+}
+
+// Count the bytes skipped at the start of a log
+func (p *progress) skip(size int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.skipped += size
+}
+
+// Count a line sent
+func (p *progress) sent() {
+	p.lines.Add(1)
+}
+
+// Report the progress every progressInterval, until stop is closed
+func (p *progress) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.report()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Report the percent done, lines per second and the time left
+func (p *progress) report() {
+	p.mutex.Lock()
+	read := int64(0)
+	for _, reader := range p.readers {
+		read += reader.reader.rawOffset()
+	}
+	skipped := p.skipped
+	p.mutex.Unlock()
+
+	elapsed := time.Since(p.started)
+	lines := p.lines.Load()
+	rate := float64(lines) / elapsed.Seconds()
+
+	message := fmt.Sprintf("%d lines, %.0f lines/sec", lines, rate)
+	if p.total > 0 {
+		if read > p.total {
+			read = p.total
+		}
+		message = fmt.Sprintf("%.1f%%, %s", float64(read)*100/float64(p.total), message)
+		if done := read - skipped; done > 0 && read < p.total {
+			left := time.Duration(float64(elapsed) * float64(p.total-read) / float64(done))
+			message += fmt.Sprintf(", ETA %s", left.Round(time.Second))
+		}
+	}
+
+	logger.Infof("Progress: %s", message)
+	if p.console {
+		fmt.Fprintf(os.Stderr, "Progress: %s\n", message)
+	}
+}
@@ -0,0 +1,104 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A pacer decides when the lines are sent in catlog mode
+type pacer interface {
+	// Wait until the line is due to be sent. Returns false if stop was
+	// closed first, and the line should not be sent.
+	wait(logData *LogData, stop <-chan struct{}) bool
+	stop()
+}
+
+// Sends a fixed number of lines per second, set with --rps
+type ratePacer struct {
+	ticker *time.Ticker
+}
+
+func newRatePacer(requestsPerSec int) (*ratePacer, error) {
+	if requestsPerSec <= 0 {
+		return nil, fmt.Errorf("requests per second must be more than 0, got %d", requestsPerSec)
+	}
+
+	// Calculate the delay between requests based on the configured rate
+	delay := time.Second / time.Duration(requestsPerSec)
+	return &ratePacer{ticker: time.NewTicker(delay)}, nil
+}
+
+func (p *ratePacer) wait(logData *LogData, stop <-chan struct{}) bool {
+	select {
+	case <-p.ticker.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+func (p *ratePacer) stop() {
+	p.ticker.Stop()
+}
+
+// Replays the lines with the time between them in the log, divided by the
+// speed, so 10 replays an hour of traffic in 6 minutes. With now, the
+// timestamps of the lines are set to the time they are sent, for Matomo to
+// show them as realtime traffic.
+type replayPacer struct {
+	speed float64
+	now   bool
+
+	// Timestamp of the first line, and when it was sent
+	first   time.Time
+	started time.Time
+}
+
+func newReplayPacer(speed float64, now bool) (*replayPacer, error) {
+	if speed <= 0 {
+		return nil, fmt.Errorf("replay speed must be more than 0, got %g", speed)
+	}
+	return &replayPacer{speed: speed, now: now}, nil
+}
+
+// Wait until the time since the first line, at the replay speed, has
+// passed. Lines with a timestamp that can't be parsed, and lines that are
+// behind, are sent right away.
+func (p *replayPacer) wait(logData *LogData, stop <-chan struct{}) bool {
+	if timestamp, err := parseTime(logData.Timestamp); err == nil {
+		if p.started.IsZero() {
+			p.first = timestamp
+			p.started = time.Now()
+		}
+		offset := time.Duration(float64(timestamp.Sub(p.first)) / p.speed)
+		if delay := time.Until(p.started.Add(offset)); delay > 0 && !sleepUntilStopped(delay, stop) {
+			return false
+		}
+	}
+
+	if p.now {
+		logData.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	return true
+}
+
+func (p *replayPacer) stop() {}
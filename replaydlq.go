@@ -0,0 +1,269 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The replay-dlq command. Sends the records in a dead-letter file again,
+// like after the config has been fixed. Rejected hits are sent with the
+// request they were built into, lines that could not be parsed are parsed
+// again with the settings of their log. The replayed records are kept next
+// to the dead-letter file with a .replayed suffix, and the records that fail
+// again, or were not sent, are written to the dead-letter file again.
+func replayDeadLetters(args []string) {
+	flags := flag.NewFlagSet("replay-dlq", flag.ExitOnError)
+	configPath := flags.String("config", "/opt/log-agent/config.toml", "Path to the configuration file")
+	batchMode := flags.Bool("batch", false, "Enable batch mode for sending the hits")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay-dlq [flags] [dead-letter file]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if *batchMode {
+		config.Batch.Mode = true
+	}
+	if flags.NArg() > 0 {
+		config.Agent.DeadLetterFile = flags.Arg(0)
+	}
+	path := config.Agent.DeadLetterFile
+	if path == "" {
+		log.Fatal("No dead-letter file, set agent.dead_letter_file or give it as argument")
+	}
+	// Agents writing to the dead-letter file hold a shared lock on it. The
+	// lock is held until the replay is done, so no agent starts writing to
+	// the file while it is moved aside.
+	lock, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		log.Fatalf("Failed to read dead-letter file: %v", err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock, false); errors.Is(err, errLocked) {
+		log.Fatalf("Dead-letter file %s is used by a running agent, stop it before replaying", path)
+	} else if err != nil {
+		log.Fatalf("Failed to lock dead-letter file: %v", err)
+	}
+
+	// The file is only moved aside once the agent is set up, so it is still
+	// there when the setup fails, like with a token that is still invalid
+	config.Agent.DeadLetterFile = ""
+	setupAgent(config)
+	replayed := fmt.Sprintf("%s.%s.replayed", path, time.Now().Format("20060102-150405"))
+	if err := os.Rename(path, replayed); err != nil {
+		logger.Fatalf("Failed to move dead-letter file: %v", err)
+	}
+	config.Agent.DeadLetterFile = path
+	if err := openDeadLetters(path); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("Replaying dead-letter file %s, moved to %s", path, replayed)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-signals
+		logger.Infof("Received %s, stopping", sig)
+		stopDelivery()
+		close(stopped)
+	}()
+
+	done, err := replayFile(replayed, config, stopped)
+	if err != nil {
+		logger.Errorf("Failed to replay dead-letter file: %v", err)
+	}
+
+	if config.Batch.Mode {
+		flushBatch(config)
+	}
+	stopSpool(true, stopped)
+	delivered.report()
+
+	// Records that were not sent, like when stopped halfway, go back to the
+	// dead-letter file
+	total, kept, err := keepUnsent(replayed, done)
+	if err != nil {
+		logger.Errorf("Failed to write the records that were not sent to %s: %v", path, err)
+	}
+	logger.Infof("Replayed %d records from %s, %d were not replayed and are back in %s", total-kept, replayed, kept, path)
+}
+
+// Send the records in a dead-letter file again. Returns for every line of
+// the file if it is done: sent to Matomo, rejected again, or written to the
+// dead-letter file again.
+func replayFile(path string, config *Config, stopped <-chan struct{}) ([]*atomic.Bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	inputs, err := config.inputConfigs()
+	if err != nil {
+		// Lines that could not be parsed are parsed with the [log] settings
+		inputs = nil
+	}
+	logs := make(map[string]*replayLog)
+
+	var done []*atomic.Bool
+	reader := bufio.NewReader(file)
+	for {
+		select {
+		case <-stopped:
+			return done, nil
+		default:
+		}
+
+		data, err := reader.ReadBytes('\n')
+		if len(data) == 0 {
+			if err == io.EOF {
+				return done, nil
+			}
+			return done, err
+		}
+		sent := new(atomic.Bool)
+		done = append(done, sent)
+		ack := func() { sent.Store(true) }
+
+		var record deadLetter
+		if err := json.Unmarshal(data, &record); err != nil {
+			logger.Warnf("Keeping an invalid dead-letter record: %v", err)
+			continue
+		}
+
+		if record.Request != "" {
+			request, err := url.ParseQuery(record.Request)
+			if err != nil {
+				logger.Warnf("Keeping a dead-letter record with an invalid request: %v", err)
+				continue
+			}
+			sendRequest(request, record.Line, config, ack)
+			continue
+		}
+
+		// A line that could not be parsed. Lines with other header lines
+		// need a parser of their own.
+		key := record.Log + "\n" + strings.Join(record.Header, "\n")
+		replay, ok := logs[key]
+		if !ok {
+			replay = &replayLog{config: replayConfig(config, inputs, record.Log)}
+			if replay.parser, err = newLogParser(replay.config); err != nil {
+				logger.Errorf("Failed to create parser for %s: %v", record.Log, err)
+			} else {
+				for _, header := range record.Header {
+					replay.parser.lineFormat.parse(header)
+				}
+			}
+			logs[key] = replay
+		}
+		if replay.parser == nil {
+			continue
+		}
+		logData, err := replay.parser.parseLog(record.Line)
+		if err == errSkipLine {
+			ack()
+			continue
+		} else if err != nil {
+			logger.Warnf("Failed to parse log line: %s (%v)", record.Line, err)
+			deadLetterLine(record.Log, replay.parser, record.Line, err)
+			ack()
+			continue
+		}
+		sendToMatomo(logData, replay.config, ack)
+	}
+}
+
+// Write the lines of the replayed file that are not done back to the
+// dead-letter file, as they were. Returns how many lines the file has, and
+// how many were written.
+func keepUnsent(path string, done []*atomic.Bool) (total int, kept int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	writer := bufio.NewWriter(deadLetterFile)
+
+	reader := bufio.NewReader(file)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			if total >= len(done) || !done[total].Load() {
+				if data[len(data)-1] != '\n' {
+					data = append(data, '\n')
+				}
+				if _, err := writer.Write(data); err != nil {
+					return total, kept, err
+				}
+				kept++
+			}
+			total++
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return total, kept, err
+		}
+	}
+	return total, kept, writer.Flush()
+}
+
+// A log with lines to parse again
+type replayLog struct {
+	config *Config
+	parser *logParser
+}
+
+// The config of the input a log belongs to, or the [log] settings if it
+// isn't one of the inputs anymore
+func replayConfig(config *Config, inputs []*Config, path string) *Config {
+	for _, input := range inputs {
+		if input.Log.LogPath == path {
+			return input
+		}
+		if matched, _ := filepath.Match(input.Log.LogPath, path); matched {
+			return input.withLogPath(path)
+		}
+	}
+	return config.withLogPath(path)
+}
@@ -0,0 +1,230 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Retry-After is honoured up to this long
+const maxRetryAfter = 10 * time.Minute
+
+// Returned when delivery stopped before the request could be sent
+var errDeliveryStopped = errors.New("delivery stopped")
+
+// Closed when the agent is stopping, so requests are not retried anymore
+var deliveryStopped = make(chan struct{})
+var stopDeliveryOnce sync.Once
+
+// Stop retrying requests, and waiting for Matomo to be back up
+func stopDelivery() {
+	stopDeliveryOnce.Do(func() { close(deliveryStopped) })
+}
+
+// Matomo could not take the request now, it can be sent again later
+type unavailableError struct {
+	status     string
+	retryAfter time.Duration
+}
+
+func (e *unavailableError) Error() string {
+	return "matomo is unavailable, status: " + e.status
+}
+
+// Matomo refused the request, sending it again won't help
+type rejectedError struct {
+	reason string
+}
+
+func (e *rejectedError) Error() string {
+	return "rejected by Matomo: " + e.reason
+}
+
+// If a request that failed with err can be sent again. Network errors can.
+func isRetryable(err error) bool {
+	var rejected *rejectedError
+	return err != nil && !errors.As(err, &rejected)
+}
+
+// Check the status of a response from the Tracker API. 5xx and 429 Too
+// Many Requests are unavailable, other 4xx are rejected.
+func checkResponse(resp *http.Response) error {
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return &unavailableError{status: resp.Status, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	case resp.StatusCode >= 400:
+		return &rejectedError{reason: resp.Status}
+	}
+	return nil
+}
+
+// Parse a Retry-After header, in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	}
+	return max(0, min(delay, maxRetryAfter))
+}
+
+// Send a request to Matomo, and send it again while it fails with an error
+// that can be retried, until it succeeds. Waits with capped exponential
+// backoff and jitter between tries, or as long as Matomo asks with
+// Retry-After. While the circuit breaker is open, waits for it to let a
+// request through. Returns errDeliveryStopped if stop is closed before the
+// request could be sent.
+func deliver(config *Config, stop <-chan struct{}, send func() error) error {
+	for attempt := 0; ; attempt++ {
+		if !matomoBreaker.allow(config, stop) {
+			return errDeliveryStopped
+		}
+
+		err := send()
+		matomoBreaker.record(config, err)
+		if !isRetryable(err) {
+			return err
+		}
+
+		delay := backoff(config, attempt)
+		var unavailable *unavailableError
+		if errors.As(err, &unavailable) && unavailable.retryAfter > delay {
+			delay = unavailable.retryAfter
+		}
+		if attempt == config.Retry.ErrorAfter {
+			logger.Errorf("Matomo still fails after %d retries, trying again in %s until it is back: %v", attempt, delay.Round(time.Millisecond), err)
+		} else {
+			logger.Warnf("Failed to send to Matomo, trying again in %s: %v", delay.Round(time.Millisecond), err)
+		}
+		if !sleepUntilStopped(delay, stop) {
+			return errDeliveryStopped
+		}
+	}
+}
+
+// Time to wait before the next try, doubling from retry.initial_backoff up
+// to retry.max_backoff. Jitter of up to half of it keeps agents that lost
+// Matomo at the same time from coming back at the same time.
+func backoff(config *Config, attempt int) time.Duration {
+	delay := config.Retry.MaxBackoff
+	if attempt < 32 {
+		delay = min(config.Retry.InitialBackoff<<attempt, config.Retry.MaxBackoff)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Wait for d, or until stop is closed. Returns false if it was closed.
+func sleepUntilStopped(d time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// The circuit breaker for requests to Matomo
+var matomoBreaker = &circuitBreaker{}
+
+// A circuitBreaker stops requests while Matomo is down. After
+// retry.breaker_threshold requests in a row failed with errors that can be
+// retried, it opens and requests wait for retry.breaker_cooldown. Then one
+// request is let through to probe Matomo. If it succeeds the breaker closes,
+// otherwise it waits for the cooldown again.
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) isOpen(config *Config) bool {
+	return config.Retry.BreakerThreshold > 0 && b.failures >= config.Retry.BreakerThreshold
+}
+
+// Wait until a request may be sent. Returns false if stop was closed.
+func (b *circuitBreaker) allow(config *Config, stop <-chan struct{}) bool {
+	for {
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+
+		b.mutex.Lock()
+		if !b.isOpen(config) {
+			b.mutex.Unlock()
+			return true
+		}
+		wait := time.Until(b.openUntil)
+		if wait <= 0 && !b.probing {
+			b.probing = true
+			b.mutex.Unlock()
+			logger.Info("Probing if Matomo is back")
+			return true
+		}
+		b.mutex.Unlock()
+
+		// Another request is probing
+		if wait <= 0 {
+			wait = 100 * time.Millisecond
+		}
+		if !sleepUntilStopped(wait, stop) {
+			return false
+		}
+	}
+}
+
+// Record the result of a request
+func (b *circuitBreaker) record(config *Config, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+	if !isRetryable(err) {
+		if b.isOpen(config) {
+			logger.Info("Matomo is back, sending again")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.isOpen(config) {
+		if b.failures == config.Retry.BreakerThreshold {
+			logger.Warnf("Matomo failed %d requests in a row, pausing for %s: %v", b.failures, config.Retry.BreakerCooldown, err)
+		}
+		b.openUntil = time.Now().Add(config.Retry.BreakerCooldown)
+	}
+}
@@ -0,0 +1,254 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A config sending to url, with short backoffs and without the breaker
+func testRetryConfig(url string) *Config {
+	config := &Config{}
+	config.Matomo.TrackerURL = url + "/"
+	config.Retry.InitialBackoff = time.Millisecond
+	config.Retry.MaxBackoff = 5 * time.Millisecond
+	return config
+}
+
+// A Tracker API that answers with the statuses in order, and then with 204
+func testTracker(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		if n > len(statuses) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if statuses[n-1] == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(statuses[n-1])
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryAfter string
+		retryable  bool
+		ok         bool
+	}{
+		{http.StatusOK, "", false, true},
+		{http.StatusNoContent, "", false, true},
+		{http.StatusBadRequest, "", false, false},
+		{http.StatusNotFound, "", false, false},
+		{http.StatusTooManyRequests, "2", true, false},
+		{http.StatusInternalServerError, "", true, false},
+		{http.StatusServiceUnavailable, "120", true, false},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: test.status, Status: http.StatusText(test.status), Header: http.Header{}}
+		if test.retryAfter != "" {
+			resp.Header.Set("Retry-After", test.retryAfter)
+		}
+		err := checkResponse(resp)
+		if (err == nil) != test.ok || isRetryable(err) != test.retryable {
+			t.Errorf("%d: got %v, retryable %v", test.status, err, isRetryable(err))
+		}
+		var unavailable *unavailableError
+		if test.retryAfter != "" && (!errors.As(err, &unavailable) || unavailable.retryAfter != parseRetryAfter(test.retryAfter)) {
+			t.Errorf("%d: Retry-After %s not kept: %v", test.status, test.retryAfter, err)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("30"); got != 30*time.Second {
+		t.Errorf("seconds: got %s", got)
+	}
+	if got := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); got < 55*time.Second || got > time.Minute {
+		t.Errorf("date: got %s", got)
+	}
+	if got := parseRetryAfter("86400"); got != maxRetryAfter {
+		t.Errorf("capped: got %s", got)
+	}
+	if got := parseRetryAfter("soon"); got != 0 {
+		t.Errorf("invalid: got %s", got)
+	}
+}
+
+func TestDeliverRetriesUnavailable(t *testing.T) {
+	matomoBreaker = &circuitBreaker{}
+	server, requests := testTracker(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+	config := testRetryConfig(server.URL)
+
+	err := deliver(config, nil, func() error {
+		return postHit(url.Values{"idsite": {"1"}, "url": {"/"}}, config)
+	})
+	if err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("sent %d requests, want 3", got)
+	}
+}
+
+func TestDeliverWaitsForRetryAfter(t *testing.T) {
+	matomoBreaker = &circuitBreaker{}
+	server, requests := testTracker(t, http.StatusTooManyRequests)
+	config := testRetryConfig(server.URL)
+
+	start := time.Now()
+	err := deliver(config, nil, func() error {
+		return postHit(url.Values{"idsite": {"1"}, "url": {"/"}}, config)
+	})
+	if err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %s, before Retry-After", waited)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("sent %d requests, want 2", got)
+	}
+}
+
+func TestDeliverDoesNotRetryRejected(t *testing.T) {
+	matomoBreaker = &circuitBreaker{}
+	server, requests := testTracker(t, http.StatusBadRequest)
+	config := testRetryConfig(server.URL)
+
+	err := deliver(config, nil, func() error {
+		return postHit(url.Values{"idsite": {"1"}, "url": {"/"}}, config)
+	})
+	var rejected *rejectedError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("got %v, want a rejectedError", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("sent %d requests, want 1", got)
+	}
+}
+
+func TestDeliverRetriesAfterErrorAfter(t *testing.T) {
+	matomoBreaker = &circuitBreaker{}
+	server, requests := testTracker(t, 503, 503, 503, 503, 503)
+	config := testRetryConfig(server.URL)
+	config.Retry.ErrorAfter = 2
+
+	err := deliver(config, nil, func() error {
+		return postHit(url.Values{"idsite": {"1"}, "url": {"/"}}, config)
+	})
+	if err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if got := requests.Load(); got != 6 {
+		t.Errorf("sent %d requests, want 6", got)
+	}
+}
+
+func TestDeliverStops(t *testing.T) {
+	matomoBreaker = &circuitBreaker{}
+	server, _ := testTracker(t, 503, 503, 503, 503, 503, 503, 503, 503, 503, 503)
+	config := testRetryConfig(server.URL)
+	config.Retry.InitialBackoff = time.Hour
+	config.Retry.MaxBackoff = time.Hour
+
+	stop := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	err := deliver(config, stop, func() error {
+		return postHit(url.Values{"idsite": {"1"}, "url": {"/"}}, config)
+	})
+	if !errors.Is(err, errDeliveryStopped) {
+		t.Fatalf("got %v, want errDeliveryStopped", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	config := &Config{}
+	config.Retry.BreakerThreshold = 2
+	config.Retry.BreakerCooldown = 50 * time.Millisecond
+	breaker := &circuitBreaker{}
+	unavailable := &unavailableError{status: "503 Service Unavailable"}
+
+	// Closed until the threshold
+	breaker.record(config, unavailable)
+	if breaker.isOpen(config) {
+		t.Fatal("open after one failure")
+	}
+	breaker.record(config, unavailable)
+	if !breaker.isOpen(config) {
+		t.Fatal("closed after two failures")
+	}
+
+	// Open, a request waits for the cooldown, and then probes
+	start := time.Now()
+	if !breaker.allow(config, nil) {
+		t.Fatal("not allowed after the cooldown")
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("probed after %s, before the cooldown", waited)
+	}
+	if !breaker.probing {
+		t.Error("not probing")
+	}
+
+	// A failed probe opens it for another cooldown
+	breaker.record(config, unavailable)
+	if !breaker.isOpen(config) || time.Until(breaker.openUntil) < 40*time.Millisecond {
+		t.Error("not open again after a failed probe")
+	}
+
+	// A request waiting while it is open stops with stop
+	stop := make(chan struct{})
+	close(stop)
+	if breaker.allow(config, stop) {
+		t.Error("allowed after stop")
+	}
+
+	// A rejected request means Matomo is up, and closes it
+	breaker.record(config, &rejectedError{reason: "400 Bad Request"})
+	if breaker.isOpen(config) || breaker.failures != 0 {
+		t.Error("still open after Matomo answered")
+	}
+	if !breaker.allow(config, nil) {
+		t.Error("not allowed when closed")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	config := &Config{}
+	breaker := &circuitBreaker{}
+	for i := 0; i < 10; i++ {
+		breaker.record(config, errors.New("connection refused"))
+	}
+	if breaker.isOpen(config) {
+		t.Error("open with breaker_threshold 0")
+	}
+}
@@ -0,0 +1,615 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Size a segment file grows to before a new one is started, at most.
+	// Segments are smaller for small spools, so dropping the oldest
+	// segment doesn't drop most of the spool.
+	spoolSegmentSize = 16 * 1024 * 1024
+	// Default limit of the size of the spool
+	defaultSpoolMaxSizeMB = 1024
+	// How long to wait before reading the spool again, after an error
+	spoolRetryInterval = 5 * time.Second
+)
+
+// Drop policies, for when the spool is full
+const (
+	spoolDropOldest = "oldest"
+	spoolDropNewest = "newest"
+	spoolBlock      = "block"
+)
+
+var errSpoolClosed = errors.New("spool is closed")
+
+// The spool hits are queued in before they are delivered, if set
+var hitSpool *spool
+
+// A hit in the spool
+type spoolRecord struct {
+	// Query string of the tracking request, without token_auth
+	Request string    `json:"request"`
+	Queued  time.Time `json:"queued"`
+	// The log line, for the dead-letter file
+	Line string `json:"line,omitempty"`
+}
+
+// Position in the spool, of the next hit to deliver
+type spoolPosition struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+func (p spoolPosition) before(other spoolPosition) bool {
+	return p.Segment < other.Segment || (p.Segment == other.Segment && p.Offset < other.Offset)
+}
+
+// A spool keeps hits on disk until they have been delivered to Matomo, so
+// hits are not lost while Matomo can't be reached. Hits are appended to
+// segment files, one JSON line per hit, and synced to disk before the log
+// line is done. A drain loop delivers the hits in order, and saves the
+// position of the next hit to deliver in a cursor file. Segments that have
+// been delivered are removed.
+type spool struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	policy      string
+
+	// The spool directory, locked so no other agent uses the spool
+	lock *os.File
+	// Closed when the agent stops, a full spool is no longer waited for
+	stop <-chan struct{}
+
+	mutex   sync.Mutex
+	changed *sync.Cond
+	// Closed when the spool is closed
+	done chan struct{}
+	// Segment ids, oldest first. The last one is being written.
+	segments []int64
+	sizes    map[int64]int64
+	writer   *os.File
+	cursor   spoolPosition
+	// Size of all segments
+	size   int64
+	closed bool
+	// If the spool is full, and the new hits that have been dropped
+	full    bool
+	dropped int64
+}
+
+// Open the spool in dir, with the hits that were not delivered last time.
+// Only one agent can have a spool open, the directory is locked until the
+// spool is closed.
+func openSpool(dir string, maxSizeMB int, policy string, stop <-chan struct{}) (_ *spool, err error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultSpoolMaxSizeMB
+	}
+	switch policy {
+	case "":
+		policy = spoolDropOldest
+	case spoolDropOldest, spoolDropNewest, spoolBlock:
+	default:
+		return nil, fmt.Errorf("unknown spool drop policy %q, use %q, %q or %q", policy, spoolDropOldest, spoolDropNewest, spoolBlock)
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	lock, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool directory: %w", err)
+	}
+	if err := lockFile(lock, false); err != nil {
+		lock.Close()
+		if errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("spool directory %s is used by another agent", dir)
+		}
+		return nil, fmt.Errorf("failed to lock spool directory: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
+
+	s := &spool{
+		dir:         dir,
+		lock:        lock,
+		stop:        stop,
+		maxSize:     int64(maxSizeMB) * 1024 * 1024,
+		segmentSize: min(spoolSegmentSize, int64(maxSizeMB)*1024*1024/8),
+		policy:      policy,
+		sizes:       make(map[int64]int64),
+	}
+	s.changed = sync.NewCond(&s.mutex)
+	s.done = make(chan struct{})
+
+	data, err := os.ReadFile(filepath.Join(dir, "cursor.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, &s.cursor); err != nil {
+			return nil, fmt.Errorf("invalid spool cursor: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read spool cursor: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	for _, entry := range entries {
+		id, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), ".seg"), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), ".seg") {
+			continue
+		}
+		if id < s.cursor.Segment {
+			// Delivered, but not removed yet
+			os.Remove(s.segmentPath(id))
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, id)
+		s.sizes[id] = info.Size()
+		s.size += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	// Hits are written to a new segment, the last one may end with half a
+	// hit if the agent was killed while writing it
+	if err := s.startSegment(); err != nil {
+		return nil, err
+	}
+	if s.cursor.Segment < s.segments[0] {
+		s.cursor = spoolPosition{Segment: s.segments[0]}
+	}
+
+	if pending := s.size - s.cursor.Offset; pending > 0 {
+		logger.Infof("Spool %s has %d bytes of hits to deliver", dir, pending)
+	}
+	return s, nil
+}
+
+func (s *spool) segmentPath(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d.seg", id))
+}
+
+// Start writing a new segment. The spool must be locked, or not in use yet.
+func (s *spool) startSegment() error {
+	id := int64(1)
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1] + 1
+	}
+
+	file, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	if s.writer != nil {
+		s.writer.Close()
+	}
+	s.writer = file
+	s.segments = append(s.segments, id)
+	s.sizes[id] = 0
+	syncDir(s.dir)
+	return nil
+}
+
+// The segment being written
+func (s *spool) writing() int64 {
+	return s.segments[len(s.segments)-1]
+}
+
+// Queue a tracking request, and the log line it was built from, in the
+// spool. It is on disk when this returns.
+// If the spool is full, the oldest hits are dropped, the request is
+// dropped, or this waits for room, by the drop policy. The wait ends with
+// errDeliveryStopped when the agent stops.
+func (s *spool) enqueue(request url.Values, line string) error {
+	data, err := json.Marshal(spoolRecord{Request: request.Encode(), Queued: time.Now().UTC(), Line: line})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var waking func()
+	for s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if s.closed {
+			return errSpoolClosed
+		}
+		if s.policy == spoolDropOldest {
+			if err := s.dropOldest(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !s.full {
+			logger.Warnf("Spool %s is full, with %d bytes of hits to deliver", s.dir, s.size)
+			s.full = true
+		}
+		if s.policy == spoolDropNewest {
+			s.dropped++
+			return nil
+		}
+
+		// The log line is not done, it is read again next time
+		select {
+		case <-s.stop:
+			return errDeliveryStopped
+		default:
+		}
+		if waking == nil {
+			waking = s.wakeOn(s.stop)
+			defer waking()
+		}
+		s.changed.Wait()
+	}
+	if s.full {
+		if s.policy == spoolDropNewest {
+			logger.Warnf("Spool %s has room again, dropped %d new hits", s.dir, s.dropped)
+		} else {
+			logger.Infof("Spool %s has room again", s.dir)
+		}
+		s.full = false
+		s.dropped = 0
+	}
+
+	if _, err := s.writer.Write(data); err != nil {
+		return fmt.Errorf("failed to write to spool: %w", err)
+	}
+	if err := s.writer.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool: %w", err)
+	}
+	s.sizes[s.writing()] += int64(len(data))
+	s.size += int64(len(data))
+
+	if s.sizes[s.writing()] >= s.segmentSize {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+	}
+	s.changed.Broadcast()
+	return nil
+}
+
+// Remove the oldest segment, with the hits in it that have not been
+// delivered. The spool must be locked.
+func (s *spool) dropOldest() error {
+	if len(s.segments) == 1 {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+	}
+
+	oldest := s.segments[0]
+	dropped := s.sizes[oldest]
+	if s.cursor.Segment == oldest {
+		dropped -= s.cursor.Offset
+		s.cursor = spoolPosition{Segment: s.segments[1]}
+		s.saveCursor()
+	}
+	s.removeSegment(oldest)
+	logger.Warnf("Spool %s is full, dropped %d bytes of the oldest hits", s.dir, dropped)
+	return nil
+}
+
+// Remove the oldest segment. The spool must be locked.
+func (s *spool) removeSegment(id int64) {
+	if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Failed to remove spool segment: %v", err)
+	}
+	s.size -= s.sizes[id]
+	delete(s.sizes, id)
+	s.segments = s.segments[1:]
+}
+
+// Read up to max hits to deliver, from the cursor, with their log lines and
+// the position after each of them. With maxBytes, only as many hits as fit
+// in maxBytes of batch payload, but at least one. Waits for hits if there
+// are none, and returns no hits when the spool is closed. position is where
+// the next read starts.
+func (s *spool) read(max int, maxBytes int) (requests []url.Values, lines []string, ends []spoolPosition, position spoolPosition, err error) {
+	s.mutex.Lock()
+	for {
+		// Move on from segments that have been read to the end
+		for s.cursor.Segment != s.writing() && s.cursor.Offset >= s.sizes[s.cursor.Segment] {
+			s.removeSegment(s.cursor.Segment)
+			s.cursor = spoolPosition{Segment: s.segments[0]}
+			s.saveCursor()
+			s.changed.Broadcast()
+		}
+		if s.closed || s.cursor.Offset < s.sizes[s.cursor.Segment] {
+			break
+		}
+		s.changed.Wait()
+	}
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, nil, nil, s.cursor, nil
+	}
+	position = s.cursor
+	end := s.sizes[position.Segment]
+	sealed := position.Segment != s.writing()
+	s.mutex.Unlock()
+
+	// Hits are only appended, so the hits up to end can be read unlocked
+	file, err := os.Open(s.segmentPath(position.Segment))
+	if err != nil {
+		return nil, nil, nil, position, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(io.NewSectionReader(file, position.Offset, end-position.Offset))
+
+	total := 0
+	for len(requests) < max {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 && sealed {
+				// Half a hit, written when the agent was killed
+				logger.Warnf("Skipping a partly written hit at the end of spool segment %d", position.Segment)
+				position.Offset = end
+			}
+			break
+		} else if err != nil {
+			return nil, nil, nil, position, err
+		}
+
+		var record spoolRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			logger.Warnf("Skipping an invalid hit in spool segment %d: %v", position.Segment, err)
+			position.Offset += int64(len(line))
+			continue
+		}
+		request, err := url.ParseQuery(record.Request)
+		if err != nil {
+			logger.Warnf("Skipping an invalid hit in spool segment %d: %v", position.Segment, err)
+			position.Offset += int64(len(line))
+			continue
+		}
+
+		// The hit is read again for the next batch
+		size := requestSize(request)
+		if maxBytes > 0 && len(requests) > 0 && total+size > maxBytes {
+			break
+		}
+		position.Offset += int64(len(line))
+		total += size
+		requests = append(requests, request)
+		lines = append(lines, record.Line)
+		ends = append(ends, position)
+	}
+
+	return requests, lines, ends, position, nil
+}
+
+// Mark the hits before position as delivered
+func (s *spool) commit(position spoolPosition) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The oldest hits may have been dropped meanwhile
+	if !s.cursor.before(position) {
+		return
+	}
+	s.cursor = position
+	s.saveCursor()
+	s.changed.Broadcast()
+}
+
+// Save the cursor, so delivered hits are not delivered again after a
+// restart. The spool must be locked.
+func (s *spool) saveCursor() {
+	data, err := json.Marshal(s.cursor)
+	if err != nil {
+		logger.Errorf("Failed to save spool cursor: %v", err)
+		return
+	}
+	if err := writeFileSynced(filepath.Join(s.dir, "cursor.json"), data); err != nil {
+		logger.Errorf("Failed to save spool cursor: %v", err)
+	}
+}
+
+// If all hits have been delivered. The spool must be locked.
+func (s *spool) empty() bool {
+	return s.cursor.Segment == s.writing() && s.cursor.Offset >= s.sizes[s.writing()]
+}
+
+// Deliver the hits in the spool, in order, until the spool is closed. Up
+// to max hits, of up to maxBytes, are delivered at a time. deliver retries
+// until the hits are sent, rejected, or the spool is closed, and returns how
+// many hits, from the start, Matomo tracked or rejected.
+func (s *spool) drain(max int, maxBytes int, deliver func([]url.Values, []string) (int, error)) {
+	for {
+		requests, lines, ends, position, err := s.read(max, maxBytes)
+		if err != nil {
+			logger.Errorf("Failed to read spool: %v", err)
+			if !sleepUntilStopped(spoolRetryInterval, s.done) {
+				return
+			}
+			continue
+		}
+		if len(requests) > 0 {
+			if handled, err := deliver(requests, lines); isRetryable(err) {
+				// The spool was closed, the rest of the hits are delivered
+				// next time. The ones Matomo tracked are not sent again.
+				if handled > 0 {
+					s.commit(ends[handled-1])
+				}
+				return
+			} else if err != nil {
+				rejectRequests(requests[handled:], lines[handled:], err)
+			}
+		}
+		s.commit(position)
+
+		s.mutex.Lock()
+		closed := s.closed
+		s.mutex.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+// Wake the waits for changes when stop is closed, until the returned
+// function is called
+func (s *spool) wakeOn(stop <-chan struct{}) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+			return
+		}
+		s.mutex.Lock()
+		s.changed.Broadcast()
+		s.mutex.Unlock()
+	}()
+	return func() { close(done) }
+}
+
+// Wait until all hits have been delivered, or stop is closed
+func (s *spool) waitEmpty(stop <-chan struct{}) {
+	waking := s.wakeOn(stop)
+	defer waking()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for !s.empty() && !s.closed {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		s.changed.Wait()
+	}
+}
+
+// Stop delivering hits. The hits that have not been delivered stay in the
+// spool, and are delivered the next time the agent starts.
+func (s *spool) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	close(s.done)
+	s.writer.Close()
+	s.lock.Close()
+	s.changed.Broadcast()
+}
+
+// Open the spool in spool.dir, and start delivering the hits in it
+func startSpool(config *Config) error {
+	s, err := openSpool(config.Spool.Dir, config.Spool.MaxSizeMB, config.Spool.DropPolicy, deliveryStopped)
+	if err != nil {
+		return err
+	}
+
+	if config.Batch.Mode {
+		go s.drain(config.Batch.Size, config.Batch.MaxBytes, func(requests []url.Values, lines []string) (int, error) {
+			return deliverBatch(config, s.done, requests, lines)
+		})
+	} else {
+		go s.drain(1, 0, func(requests []url.Values, lines []string) (int, error) {
+			return 0, deliver(config, s.done, func() error {
+				return postHit(requests[0], config)
+			})
+		})
+	}
+
+	hitSpool = s
+	logger.Infof("Spooling hits in %s", config.Spool.Dir)
+	return nil
+}
+
+// Stop the spool. With wait, first wait until the hits in it have been
+// delivered, or stop is closed.
+func stopSpool(wait bool, stop <-chan struct{}) {
+	if hitSpool == nil {
+		return
+	}
+	if wait {
+		logger.Info("Waiting for the spooled hits to be delivered")
+		hitSpool.waitEmpty(stop)
+	}
+	hitSpool.close()
+}
+
+// Queue a hit in the spool. The log line is done once the hit is on disk,
+// or dropped by the drop policy. If it could not be spooled, the line is not
+// done, and it is read again when tailing or an import resumes.
+func spoolHit(request url.Values, line string, ack func()) error {
+	if err := hitSpool.enqueue(request, line); err != nil {
+		return err
+	}
+	ack()
+	return nil
+}
+
+// Write a file and sync it to disk, replacing it atomically
+func writeFileSynced(path string, data []byte) error {
+	temp := path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Sync a directory, so new and renamed files in it are on disk
+func syncDir(dir string) {
+	if file, err := os.Open(dir); err == nil {
+		file.Sync()
+		file.Close()
+	}
+}
@@ -0,0 +1,371 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// About 1KB in the spool
+var testSpoolLine = strings.Repeat("x", 900)
+
+func testSpoolRequest(i int) url.Values {
+	return url.Values{"idsite": {"1"}, "url": {fmt.Sprintf("/page/%d", i)}}
+}
+
+func openTestSpool(t *testing.T, dir string, maxSizeMB int, policy string, stop <-chan struct{}) *spool {
+	t.Helper()
+	s, err := openSpool(dir, maxSizeMB, policy, stop)
+	if err != nil {
+		t.Fatalf("openSpool: %v", err)
+	}
+	return s
+}
+
+// Read and commit all hits in the spool, and return their urls
+func readSpool(t *testing.T, s *spool) []string {
+	t.Helper()
+	var urls []string
+	for {
+		// read waits for hits if there are none left
+		s.mutex.Lock()
+		pending := s.sizes[s.cursor.Segment] - s.cursor.Offset
+		for _, id := range s.segments {
+			if id > s.cursor.Segment {
+				pending += s.sizes[id]
+			}
+		}
+		s.mutex.Unlock()
+		if pending == 0 {
+			return urls
+		}
+		requests, _, _, position, err := s.read(100, 0)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		for _, request := range requests {
+			urls = append(urls, request.Get("url"))
+		}
+		s.commit(position)
+	}
+}
+
+func TestSpoolCursor(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1, spoolDropOldest, nil)
+	for i := 0; i < 3; i++ {
+		if err := s.enqueue(testSpoolRequest(i), fmt.Sprintf("line %d", i)); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	requests, lines, _, position, err := s.read(2, 0)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(requests) != 2 || requests[0].Get("url") != "/page/0" || lines[1] != "line 1" {
+		t.Fatalf("read %v %v", requests, lines)
+	}
+	s.commit(position)
+	s.close()
+
+	// The hits that were delivered are not read again
+	s = openTestSpool(t, dir, 1, spoolDropOldest, nil)
+	defer s.close()
+	requests, lines, _, _, err = s.read(10, 0)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(requests) != 1 || requests[0].Get("url") != "/page/2" || lines[0] != "line 2" {
+		t.Errorf("read %v %v after reopening, want /page/2", requests, lines)
+	}
+}
+
+func TestSpoolReadMaxBytes(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), 1, spoolDropOldest, nil)
+	defer s.close()
+	for i := 0; i < 5; i++ {
+		if err := s.enqueue(testSpoolRequest(i), ""); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	size := requestSize(testSpoolRequest(0))
+	requests, _, _, _, err := s.read(10, 2*size+1)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(requests) != 2 {
+		t.Errorf("read %d hits, want 2", len(requests))
+	}
+
+	// At least one hit, even if it doesn't fit
+	requests, _, _, _, err = s.read(10, 1)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("read %d hits, want 1", len(requests))
+	}
+}
+
+func TestSpoolSegments(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1, spoolDropOldest, nil)
+	defer s.close()
+
+	// Segments are 128KB with a 1MB spool
+	for i := 0; i < 300; i++ {
+		if err := s.enqueue(testSpoolRequest(i), testSpoolLine); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	if len(s.segments) < 3 {
+		t.Fatalf("%d segments, want at least 3", len(s.segments))
+	}
+
+	urls := readSpool(t, s)
+	if len(urls) != 300 {
+		t.Fatalf("read %d hits, want 300", len(urls))
+	}
+	for i, u := range urls {
+		if u != fmt.Sprintf("/page/%d", i) {
+			t.Fatalf("hit %d is %s, out of order", i, u)
+		}
+	}
+
+	// Segments that have been delivered are removed
+	files, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(files) > 2 {
+		t.Errorf("%d segments left after delivering all hits", len(files))
+	}
+}
+
+func TestSpoolDropOldest(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), 1, spoolDropOldest, nil)
+	defer s.close()
+	for i := 0; i < 1500; i++ {
+		if err := s.enqueue(testSpoolRequest(i), testSpoolLine); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	if s.size > s.maxSize {
+		t.Errorf("spool has %d bytes, more than %d", s.size, s.maxSize)
+	}
+
+	urls := readSpool(t, s)
+	if len(urls) == 0 || len(urls) >= 1500 || urls[0] == "/page/0" || urls[len(urls)-1] != "/page/1499" {
+		t.Errorf("read %d hits, from %v, want the newest hits", len(urls), urls[:1])
+	}
+}
+
+func TestSpoolDropNewest(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), 1, spoolDropNewest, nil)
+	defer s.close()
+	for i := 0; i < 1500; i++ {
+		if err := s.enqueue(testSpoolRequest(i), testSpoolLine); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	if !s.full || s.dropped == 0 {
+		t.Errorf("full %v, dropped %d, want new hits dropped", s.full, s.dropped)
+	}
+
+	urls := readSpool(t, s)
+	if len(urls) == 0 || len(urls) >= 1500 || urls[0] != "/page/0" || urls[len(urls)-1] == "/page/1499" {
+		t.Errorf("read %d hits, from %v, want the oldest hits", len(urls), urls[:1])
+	}
+}
+
+// Enqueue hits until the spool is full, in a goroutine. Returns the number
+// of hits queued, and the error that ended enqueuing.
+func fillBlockingSpool(t *testing.T, s *spool) (*atomic.Int32, chan error) {
+	t.Helper()
+	var queued atomic.Int32
+	result := make(chan error, 1)
+	go func() {
+		for i := 0; i < 1500; i++ {
+			if err := s.enqueue(testSpoolRequest(i), testSpoolLine); err != nil {
+				result <- err
+				return
+			}
+			queued.Add(1)
+		}
+		result <- nil
+	}()
+
+	select {
+	case err := <-result:
+		t.Fatalf("enqueue did not wait for room: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if n := queued.Load(); n == 0 || n >= 1500 {
+		t.Fatalf("queued %d hits", n)
+	}
+	return &queued, result
+}
+
+func TestSpoolBlockStops(t *testing.T) {
+	stop := make(chan struct{})
+	s := openTestSpool(t, t.TempDir(), 1, spoolBlock, stop)
+	defer s.close()
+	_, result := fillBlockingSpool(t, s)
+
+	close(stop)
+	select {
+	case err := <-result:
+		if !errors.Is(err, errDeliveryStopped) {
+			t.Errorf("got %v, want errDeliveryStopped", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueue still waits after stop")
+	}
+}
+
+func TestSpoolBlockWaitsForRoom(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), 1, spoolBlock, make(chan struct{}))
+	defer s.close()
+	queued, result := fillBlockingSpool(t, s)
+
+	// Delivering hits makes room for the rest
+	var urls []string
+	for len(urls) < 1500 {
+		requests, _, _, position, err := s.read(100, 0)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		for _, request := range requests {
+			urls = append(urls, request.Get("url"))
+		}
+		s.commit(position)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if queued.Load() != 1500 || urls[1499] != "/page/1499" {
+		t.Errorf("queued %d hits, last read %s", queued.Load(), urls[len(urls)-1])
+	}
+}
+
+func TestSpoolLock(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1, spoolDropOldest, nil)
+	if _, err := openSpool(dir, 1, spoolDropOldest, nil); err == nil || !strings.Contains(err.Error(), "used by another agent") {
+		t.Errorf("opened a spool that is in use: %v", err)
+	}
+	s.close()
+
+	s = openTestSpool(t, dir, 1, spoolDropOldest, nil)
+	s.close()
+}
+
+func TestSpoolDrain(t *testing.T) {
+	matomoBreaker = &circuitBreaker{}
+	// Unavailable twice, then rate limited once, and /bad is rejected
+	var mutex sync.Mutex
+	var tracked []string
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		r.ParseForm()
+		switch {
+		case n <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case n == 3:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.Form.Get("url") == "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			mutex.Lock()
+			tracked = append(tracked, r.Form.Get("url"))
+			mutex.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+	config := testRetryConfig(server.URL)
+
+	stop := make(chan struct{})
+	s := openTestSpool(t, t.TempDir(), 1, spoolDropOldest, stop)
+	for _, u := range []string{"/page/0", "/bad", "/page/2"} {
+		if err := s.enqueue(url.Values{"idsite": {"1"}, "url": {u}}, ""); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	rejected := delivered.rejected.Load()
+	drained := make(chan struct{})
+	go func() {
+		s.drain(1, 0, func(requests []url.Values, lines []string) (int, error) {
+			return 0, deliver(config, s.done, func() error { return postHit(requests[0], config) })
+		})
+		close(drained)
+	}()
+
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(10*time.Second, func() { close(timeout) })
+	defer timer.Stop()
+	s.waitEmpty(timeout)
+	s.close()
+	<-drained
+
+	if got := strings.Join(tracked, " "); got != "/page/0 /page/2" {
+		t.Errorf("tracked %s, want /page/0 /page/2", got)
+	}
+	if got := delivered.rejected.Load() - rejected; got != 1 {
+		t.Errorf("rejected %d hits, want 1", got)
+	}
+}
+
+func TestSpoolDrainCommitsHandledHits(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1, spoolDropOldest, nil)
+	for i := 0; i < 3; i++ {
+		if err := s.enqueue(testSpoolRequest(i), ""); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	// Matomo tracked the first two hits of the batch, and the agent stopped
+	// while retrying the last one
+	s.drain(10, 0, func(requests []url.Values, lines []string) (int, error) {
+		if len(requests) != 3 {
+			t.Errorf("delivering %d hits, want 3", len(requests))
+		}
+		return 2, errDeliveryStopped
+	})
+	s.close()
+
+	s = openTestSpool(t, dir, 1, spoolDropOldest, nil)
+	defer s.close()
+	if urls := readSpool(t, s); len(urls) != 1 || urls[0] != "/page/2" {
+		t.Errorf("read %v after restarting, want /page/2", urls)
+	}
+}
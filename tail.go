@@ -20,40 +20,369 @@
 package main
 
 import (
-	"github.com/tenebris-tech/tail"
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-// Tail the log file based on configuration and send to Matomo
+// How often to look for new files matching the input paths
+const inputScanInterval = 10 * time.Second
+
+// A file being tailed, for one of the inputs
+type tailedFile struct {
+	config   *Config
+	parser   *logParser
+	follower *follower
+	tracker  *offsetTracker
+	// The lines --since and --until apply to: the lines that were in the
+	// file when tailing started, or all of stdin. Lines written later are
+	// always sent.
+	catchUp    fileID
+	catchUpEnd int64
+	stdin      bool
+}
+
+// A line read from a tailed file
+type tailedLine struct {
+	followedLine
+	file *tailedFile
+}
+
+// A tailer follows the files of all inputs, and sends the lines from all of
+// them to Matomo, one at a time.
+type tailer struct {
+	inputs      []*Config
+	checkpoints *checkpointStore
+	files       map[string]*tailedFile
+	// Why a file could not be tailed, so the error is only logged once
+	failed map[string]string
+	// If stdin has been read to the end
+	stdinEnded bool
+	// If the files found at startup have been added
+	started bool
+
+	lines chan tailedLine
+	ended chan string
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Tail the log files based on configuration and send to Matomo. With a state
+// file, tailing resumes where it stopped last time.
 func tailLogFile(config *Config) {
-	var logFilePath string
-	if config.Log.LogFormat == "nginx" || config.Log.LogFormat == "apache" || config.Log.LogFormat == "csv" {
-		logFilePath = config.Log.LogPath
-	} else {
-		logger.Fatal("Invalid log format in config")
+	inputs, err := config.inputConfigs()
+	if err != nil {
+		logger.Fatalf("Invalid inputs in config: %v", err)
 	}
 
-	// Open the log file for tailing
-	t, err := tail.TailFile(logFilePath, tail.Config{Follow: true})
+	checkpoints, err := loadCheckpoints(config.Agent.StateFile, tailCheckpoints)
 	if err != nil {
-		logger.Fatal("Failed to open log file:", err)
+		logger.Fatalf("Failed to load checkpoints: %v", err)
 	}
+	stopCheckpoints := make(chan struct{})
+	checkpointsSaved := make(chan struct{})
+	go func() {
+		checkpoints.run(stopCheckpoints)
+		close(checkpointsSaved)
+	}()
 
-	// Process each line from the log file
-	for line := range t.Lines {
-		// Parse the log line
-		logData := parseLog(line.Text, config.Log.LogFormat)
-		if logData == nil {
-			logger.Warnf("Failed to parse log line: %s", line.Text)
-			continue
+	t := &tailer{
+		inputs:      inputs,
+		checkpoints: checkpoints,
+		files:       make(map[string]*tailedFile),
+		failed:      make(map[string]string),
+		lines:       make(chan tailedLine),
+		ended:       make(chan string),
+		stop:        make(chan struct{}),
+	}
+	t.scan()
+	t.started = true
+
+	// Stop on SIGINT or SIGTERM, and save the checkpoints of the hits that
+	// have been sent
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopping := make(chan struct{})
+	go func() {
+		sig := <-signals
+		logger.Infof("Received %s, stopping", sig)
+		// Don't keep retrying a hit that Matomo doesn't take
+		stopDelivery()
+		close(stopping)
+	}()
+
+	scanTicker := time.NewTicker(inputScanInterval)
+	defer scanTicker.Stop()
+
+	// Process each line from the log files, and pick up new files
+	running := true
+	stdinEnded := false
+	for running {
+		select {
+		case line := <-t.lines:
+			t.process(line)
+		case <-scanTicker.C:
+			t.scan()
+		case path := <-t.ended:
+			t.remove(path)
+			if path == stdinPath && len(t.inputs) == 1 {
+				// All lines from stdin have been processed
+				logger.Infof("Finished reading %s, stopping", path)
+				running = false
+				stdinEnded = true
+			}
+		case <-stopping:
+			running = false
 		}
+	}
+	t.close()
+
+	// Send what is left in the batch, so it is committed too
+	if config.Batch.Mode {
+		flushBatch(config)
+	}
+
+	// Hits still in the spool are delivered the next time the agent starts,
+	// but when stdin has ended there is no next time for it
+	stopSpool(stdinEnded, stopping)
+	delivered.report()
 
-		// Check if the request URL contains an ignored media file extension (without query params)
-		if isIgnored(logData.URL) {
-			logger.Debugf("Skipping media file request: %s", logData.URL)
-			continue
+	// Reading stdin is a backfill, like catlog mode
+	if config.Matomo.InvalidateReports && config.Log.LogPath == stdinPath && len(config.Inputs) == 0 {
+		if err := invalidateArchivedReports(config); err != nil {
+			logger.Errorf("Failed to invalidate archived reports: %v", err)
 		}
+	}
+
+	close(stopCheckpoints)
+	<-checkpointsSaved
+}
 
-		// Send parsed log to Matomo
-		sendToMatomo(logData, config)
+// Start tailing the files matching the input paths that aren't tailed yet.
+// A file matching more than one input is tailed for the first of them.
+func (t *tailer) scan() {
+	for _, input := range t.inputs {
+		for _, path := range inputPaths(input) {
+			if _, ok := t.files[path]; ok || (path == stdinPath && t.stdinEnded) {
+				continue
+			}
+			if err := t.add(path, input.withLogPath(path)); err != nil {
+				// Stdin won't come back later
+				if path == stdinPath {
+					logger.Fatalf("Failed to read stdin: %v", err)
+				}
+				// A log format that is wrong at startup stays wrong, only
+				// files that are missing or empty yet are tried again
+				var formatErr *formatError
+				if !t.started && errors.As(err, &formatErr) {
+					logger.Fatalf("Invalid log format in config for %s: %v", path, err)
+				}
+				if t.failed[path] != err.Error() {
+					logger.Errorf("Failed to tail %s: %v", path, err)
+					t.failed[path] = err.Error()
+				}
+				continue
+			}
+			delete(t.failed, path)
+		}
+	}
+}
+
+// Start tailing a file, with the config of its input
+func (t *tailer) add(path string, config *Config) error {
+	// Every file needs its own parser, as some formats keep state between
+	// lines, and the format may be detected per file
+	parser, err := newLogParser(config)
+	if err != nil {
+		return err
+	}
+
+	// Pipes are read as they come, without checkpoints
+	var follower *follower
+	var tracker *offsetTracker
+	if isPipe(path) {
+		follower, err = followPipe(path)
+	} else {
+		options := followOptions{Poll: config.Log.Poll, PollInterval: config.Log.PollInterval}
+		offset := t.startOffset(path, config)
+		if offset > 0 {
+			readHeader(path, parser, offset)
+		}
+		follower, err = followFile(path, offset, options)
+		tracker = t.checkpoints.tracker(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	file := &tailedFile{
+		config:   config,
+		parser:   parser,
+		follower: follower,
+		tracker:  tracker,
+		stdin:    path == stdinPath,
+	}
+	// The window only applies to catching up on the files there at startup
+	if !t.started && config.Window.isSet() && !file.stdin {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			file.catchUp.Device, file.catchUp.Inode = fileIdentity(info)
+			file.catchUpEnd = info.Size()
+		}
 	}
+	t.files[path] = file
+	logger.Infof("Tailing %s", path)
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for line := range follower.Lines {
+			select {
+			case t.lines <- tailedLine{line, file}:
+			case <-t.stop:
+				return
+			}
+		}
+		// Stdin ends, a named pipe that could not be opened, and a file
+		// that has been removed
+		select {
+		case t.ended <- path:
+		case <-t.stop:
+		}
+	}()
+
+	return nil
+}
+
+// Stop tailing a file that ended. A named pipe, or a file that is created
+// again, is opened again with the next scan. Stdin is done.
+func (t *tailer) remove(path string) {
+	file, ok := t.files[path]
+	if !ok {
+		return
+	}
+	file.follower.Stop()
+	delete(t.files, path)
+	if path == stdinPath {
+		// Stdin can only be read once
+		t.stdinEnded = true
+		return
+	}
+	if file.tracker == nil {
+		logger.Infof("Stopped reading %s, opening it again later", path)
+	} else {
+		logger.Infof("Stopped tailing %s, it has been removed", path)
+	}
+}
+
+// Where to start tailing a file: at its checkpoint, or with --since and
+// without a checkpoint, at the lines from since on
+func (t *tailer) startOffset(path string, config *Config) int64 {
+	offset := t.checkpoints.resumeOffset(path)
+	since := config.Window.Since
+	if offset > 0 || since.IsZero() || !isSeekable(path) {
+		return offset
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	offset, err = seekSince(file, config, since)
+	if err != nil {
+		logger.Warnf("Failed to seek to %s in %s, reading from the start: %v", since, path, err)
+		return 0
+	}
+	if offset > 0 {
+		logger.Infof("Catching up on %s from offset %d, for %s", path, offset, since)
+	}
+	return offset
+}
+
+// If --since and --until apply to a line. Once a line past the end of the
+// catch-up has been read, they no longer apply to the file.
+func (file *tailedFile) windowed(line followedLine) bool {
+	if file.stdin {
+		return true
+	}
+	if file.catchUpEnd == 0 {
+		return false
+	}
+	if line.Offset > file.catchUpEnd || line.File.Device != file.catchUp.Device || line.File.Inode != file.catchUp.Inode {
+		file.catchUpEnd = 0
+		return false
+	}
+	return true
+}
+
+// Parse the lines before the first request of a file that isn't read from
+// the start, for formats like W3C that need their header lines
+func readHeader(path string, parser *logParser, offset int64) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(io.LimitReader(file, offset))
+	for {
+		text, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if _, err := parser.lineFormat.parse(strings.TrimRight(text, "\r\n")); err != errSkipLine {
+			return
+		}
+	}
+}
+
+// Stop tailing all files. Lines that have been read but not processed are
+// not committed, so they are read again next time.
+func (t *tailer) close() {
+	close(t.stop)
+	for _, file := range t.files {
+		file.follower.Stop()
+	}
+	t.wg.Wait()
+}
+
+// Parse a line and send it to Matomo
+func (t *tailer) process(line tailedLine) {
+	file := line.file
+	ack := file.tracker.track(line.followedLine)
+
+	// Parse the log line
+	logData, err := file.parser.parseLog(line.Text)
+	if err == errSkipLine {
+		ack()
+		return
+	} else if err != nil {
+		logger.Warnf("Failed to parse log line: %s (%v)", line.Text, err)
+		deadLetterLine(file.config.Log.LogPath, file.parser, line.Text, err)
+		ack()
+		return
+	}
+
+	// Skip lines outside --since and --until
+	if file.windowed(line.followedLine) && !file.config.Window.includes(logData) {
+		ack()
+		return
+	}
+
+	// Check if the request URL contains an ignored media file extension (without query params)
+	if isIgnored(logData.URL) {
+		logger.Debugf("Skipping media file request: %s", logData.URL)
+		ack()
+		return
+	}
+
+	// Send parsed log to Matomo
+	sendToMatomo(logData, file.config, ack)
 }
@@ -0,0 +1,189 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A w3cFormat parses logs in the W3C extended log file format, where a
+// #Fields directive names the columns of the lines after it. The parser
+// keeps the columns and date between lines, so one parser must read the
+// lines of a log in order.
+type w3cFormat struct {
+	separator string
+	fields    []string
+	// Date of the #Date directive, for logs with time but no date field
+	date string
+	// The #Fields and #Date directives the fields and date are from
+	fieldsLine string
+	dateLine   string
+	// Unit of time-taken, it differs between servers
+	timeTakenUnit time.Duration
+	// Undo the encoding of a field value, if the server encodes them
+	decode func(field, value string) string
+}
+
+// W3C extended logs as written by IIS, space separated with time-taken in
+// milliseconds. Spaces in values are replaced with +, other servers quote
+// values with spaces.
+func newW3CFormat() *w3cFormat {
+	return &w3cFormat{
+		separator:     " ",
+		timeTakenUnit: time.Millisecond,
+		decode: func(field, value string) string {
+			if field == "cs(User-Agent)" || field == "cs(Cookie)" {
+				return strings.ReplaceAll(value, "+", " ")
+			}
+			return value
+		},
+	}
+}
+
+func (f *w3cFormat) parse(line string) (*LogData, error) {
+	if strings.HasPrefix(line, "#") {
+		f.directive(line)
+		return nil, errSkipLine
+	}
+	if strings.TrimSpace(line) == "" {
+		return nil, errSkipLine
+	}
+	if len(f.fields) == 0 {
+		return nil, fmt.Errorf("no #Fields directive before the line")
+	}
+
+	var values []string
+	if f.separator == " " {
+		values = splitQuotedFields(line)
+	} else {
+		values = strings.Split(line, f.separator)
+	}
+	if len(values) < len(f.fields) {
+		return nil, fmt.Errorf("line has %d fields, #Fields names %d", len(values), len(f.fields))
+	}
+
+	logData := &LogData{}
+	var date, clock, query string
+	for i, field := range f.fields {
+		value := values[i]
+		if value == "-" {
+			continue
+		}
+		if f.decode != nil {
+			value = f.decode(field, value)
+		}
+
+		switch field {
+		case "date":
+			date = value
+		case "time":
+			clock = value
+		case "c-ip":
+			logData.IP = value
+		case "cs-username":
+			logData.User = value
+		case "cs-method":
+			logData.Method = value
+		case "cs-uri-stem":
+			logData.URL = value
+		case "cs-uri-query":
+			query = value
+		case "cs-uri":
+			logData.URL = value
+		case "sc-status":
+			logData.Status = value
+		case "sc-bytes":
+			logData.Size = value
+		case "cs(Referer)":
+			logData.Referrer = value
+		case "cs(User-Agent)":
+			logData.UserAgent = value
+		case "x-host-header", "cs-host":
+			logData.Host = value
+		case "cs(Host)":
+			if logData.Host == "" {
+				logData.Host = value
+			}
+		case "cs-protocol":
+			logData.Scheme = value
+		case "cs-version", "cs-protocol-version":
+			logData.Protocol = value
+		case "time-taken":
+			logData.Duration = parseDuration(value, f.timeTakenUnit)
+		default:
+			if logData.Fields == nil {
+				logData.Fields = make(map[string]string)
+			}
+			logData.Fields[field] = value
+		}
+	}
+
+	if query != "" {
+		logData.URL += "?" + query
+	}
+	if logData.Scheme == "" && logData.Fields["s-port"] == "443" {
+		logData.Scheme = "https"
+	}
+
+	// Times in W3C logs are in UTC
+	if date == "" {
+		date = f.date
+	}
+	if date != "" && clock != "" {
+		logData.Timestamp = date + "T" + clock + "Z"
+	}
+
+	return logData, nil
+}
+
+func (f *w3cFormat) headerLines() []string {
+	var lines []string
+	for _, line := range []string{f.fieldsLine, f.dateLine} {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Read a directive line, like "#Fields: date time c-ip". Directives can
+// come again later in the log, like when IIS is restarted, and then apply
+// to the lines after them.
+func (f *w3cFormat) directive(line string) {
+	name, value, found := strings.Cut(strings.TrimPrefix(line, "#"), ":")
+	if !found {
+		return
+	}
+
+	switch strings.TrimSpace(name) {
+	case "Fields":
+		f.fields = strings.Fields(value)
+		f.fieldsLine = line
+		logger.Debugf("Log fields are now: %s", strings.Join(f.fields, " "))
+	case "Date":
+		// Like "#Date: 2024-10-23 12:00:00"
+		if date, _, _ := strings.Cut(strings.TrimSpace(value), " "); date != "" {
+			f.date = date
+			f.dateLine = line
+		}
+	}
+}
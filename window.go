@@ -0,0 +1,176 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Logs are not strictly in timestamp order, as requests are logged when
+	// they end, with the time they started or ended. Lines this much after
+	// --until are read before a log is taken to have passed the window, and
+	// seeking to --since backs off this many bytes.
+	windowSlack       = time.Minute
+	windowSeekBackoff = 64 * 1024
+	// Lines to read at an offset to find a timestamp while seeking
+	windowProbeLines = 100
+)
+
+// Time window of the lines to send, from --since and --until. A zero time
+// leaves that end of the window open.
+type timeWindow struct {
+	Since time.Time
+	Until time.Time
+}
+
+// Layouts accepted for --since and --until, without a zone in local time
+var windowTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Parse the time of --since or --until
+func parseWindowTime(value string) (time.Time, error) {
+	for _, layout := range windowTimeLayouts {
+		if parsed, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use like 2024-10-23 12:00:00 or 2024-10-23T12:00:00+02:00", value)
+}
+
+func (w timeWindow) isSet() bool {
+	return !w.Since.IsZero() || !w.Until.IsZero()
+}
+
+// If the line is in the window. Lines with a timestamp that can't be parsed
+// are not, when there is a window.
+func (w timeWindow) includes(logData *LogData) bool {
+	if !w.isSet() {
+		return true
+	}
+	parsed, err := parseTime(logData.Timestamp)
+	if err != nil {
+		return false
+	}
+	if !w.Since.IsZero() && parsed.Before(w.Since) {
+		return false
+	}
+	if !w.Until.IsZero() && parsed.After(w.Until) {
+		return false
+	}
+	return true
+}
+
+// If the line is so far after the window that the rest of the log can be
+// skipped
+func (w timeWindow) passed(logData *LogData) bool {
+	if w.Until.IsZero() {
+		return false
+	}
+	parsed, err := parseTime(logData.Timestamp)
+	return err == nil && parsed.After(w.Until.Add(windowSlack))
+}
+
+// Find the offset to start reading a time ordered log at, to get to the
+// lines from since on, by binary search on byte offsets. The lines are
+// probed with a parser of their own, that first reads the header lines of
+// the log, for formats like W3C, where the lines can't be parsed without
+// them. The parser the log is read with keeps its header state.
+func seekSince(file *os.File, config *Config, since time.Time) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	parser, err := newLogParser(config)
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	// The first request in the log, after the header lines
+	first, ok := probeTime(file, parser, 0, size)
+	if !ok || !first.Before(since) {
+		return 0, nil
+	}
+
+	// The line at low is before since, the line at high is not, or unknown
+	low, high := int64(0), size
+	for high-low > windowSeekBackoff {
+		middle := low + (high-low)/2
+		probed, ok := probeTime(file, parser, middle, size)
+		if ok && probed.Before(since) {
+			low = middle
+		} else {
+			high = middle
+		}
+	}
+
+	if low < windowSeekBackoff {
+		return 0, nil
+	}
+	return lineStart(file, low-windowSeekBackoff, size)
+}
+
+// The timestamp of the first request on a line starting after offset
+func probeTime(file *os.File, parser *logParser, offset, size int64) (time.Time, bool) {
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+	if offset > 0 {
+		// Skip the rest of the line offset is in
+		if _, err := reader.ReadString('\n'); err != nil {
+			return time.Time{}, false
+		}
+	}
+
+	for i := 0; i < windowProbeLines; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// The last line may still be being written
+			return time.Time{}, false
+		}
+		logData, parseErr := parser.lineFormat.parse(strings.TrimRight(line, "\r\n"))
+		if parseErr == nil {
+			if parsed, err := parseTime(logData.Timestamp); err == nil {
+				return parsed, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// The offset of the start of the first line after offset
+func lineStart(file *os.File, offset, size int64) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, size-offset))
+	rest, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	return offset + int64(len(rest)), nil
+}
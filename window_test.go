@@ -0,0 +1,213 @@
+/**
+ * A log agent for Matomo.
+ *
+ * Copyright (C) 2024 Digitalist Open Cloud <cloud@digitalist.com>
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Time of the first line of the test logs, every next line is a second later
+var testLogStart = time.Date(2024, 10, 23, 0, 0, 0, 0, time.UTC)
+
+// Write a log with the header lines, and count lines made by line. Returns
+// the path, and the offset every line starts at.
+func writeTestLog(t *testing.T, header []string, count int, line func(i int, timestamp time.Time) string) (string, []int64) {
+	t.Helper()
+	var log strings.Builder
+	for _, text := range header {
+		log.WriteString(text + "\n")
+	}
+	starts := make([]int64, count)
+	for i := range starts {
+		starts[i] = int64(log.Len())
+		log.WriteString(line(i, testLogStart.Add(time.Duration(i)*time.Second)) + "\n")
+	}
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(path, []byte(log.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, starts
+}
+
+func nginxTestLine(i int, timestamp time.Time) string {
+	return fmt.Sprintf(`203.0.113.7 - - [%s] "GET /page/%d HTTP/1.1" 200 512 "-" "Mozilla/5.0"`, timestamp.Format("02/Jan/2006:15:04:05 -0700"), i)
+}
+
+// Seek to since, and check that no line from since on is skipped, and that
+// not much more than windowSeekBackoff before it is read. Returns the index
+// of the line seeking ended at.
+func checkSeekSince(t *testing.T, path string, config *Config, starts []int64, since time.Time) int {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	offset, err := seekSince(file, config, since)
+	if err != nil {
+		t.Fatalf("seekSince: %v", err)
+	}
+	if offset == 0 {
+		return 0
+	}
+
+	// The first line from since on
+	first := int(since.Sub(testLogStart) / time.Second)
+	if since.After(testLogStart.Add(time.Duration(first) * time.Second)) {
+		first++
+	}
+	end := int64(0)
+	if first < len(starts) {
+		end = starts[first]
+	} else {
+		info, _ := file.Stat()
+		end = info.Size()
+	}
+
+	for i, start := range starts {
+		if start == offset {
+			if offset > end {
+				t.Errorf("seeked to line %d, past line %d at %s", i, first, since)
+			}
+			if end-offset > 2*windowSeekBackoff {
+				t.Errorf("seeked to offset %d, %d bytes before line %d at %s", offset, end-offset, first, since)
+			}
+			return i
+		}
+	}
+	t.Fatalf("seeked to offset %d, not the start of a line", offset)
+	return 0
+}
+
+func TestSeekSince(t *testing.T) {
+	path, starts := writeTestLog(t, nil, 10000, nginxTestLine)
+	config := &Config{}
+	config.Log.LogFormat = "nginx"
+
+	tests := []struct {
+		name   string
+		since  time.Time
+		seeked bool
+	}{
+		{"before the log", testLogStart.Add(-time.Hour), false},
+		{"at the start", testLogStart, false},
+		{"in the middle", testLogStart.Add(5000 * time.Second), true},
+		{"between lines", testLogStart.Add(7500*time.Second + 500*time.Millisecond), true},
+		{"near the end", testLogStart.Add(9990 * time.Second), true},
+		{"after the log", testLogStart.Add(24 * time.Hour), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if line := checkSeekSince(t, path, config, starts, test.since); (line > 0) != test.seeked {
+				t.Errorf("seeked to line %d", line)
+			}
+		})
+	}
+}
+
+func TestSeekSinceUnparsableLines(t *testing.T) {
+	// Lines that can't be parsed at the offsets probed are not taken to be
+	// before since
+	path, starts := writeTestLog(t, nil, 5000, func(i int, timestamp time.Time) string {
+		if i%2 == 1 {
+			return "garbage"
+		}
+		return nginxTestLine(i, timestamp)
+	})
+	config := &Config{}
+	config.Log.LogFormat = "nginx"
+
+	if line := checkSeekSince(t, path, config, starts, testLogStart.Add(4000*time.Second)); line == 0 {
+		t.Error("did not seek")
+	}
+}
+
+func TestSeekSinceHeaderFormat(t *testing.T) {
+	header := []string{
+		"#Software: Microsoft Internet Information Services 10.0",
+		"#Fields: date time c-ip cs-method cs-uri-stem sc-status",
+	}
+	path, starts := writeTestLog(t, header, 20000, func(i int, timestamp time.Time) string {
+		return fmt.Sprintf("%s 203.0.113.7 GET /page/%d 200", timestamp.Format("2006-01-02 15:04:05"), i)
+	})
+	config := &Config{}
+	config.Log.LogFormat = "w3c"
+
+	line := checkSeekSince(t, path, config, starts, testLogStart.Add(15000*time.Second))
+	if line == 0 {
+		t.Fatal("did not seek, the lines were probed without the #Fields header")
+	}
+
+	// The parser the log is read with gets the header lines before the offset
+	parser, err := newLogParser(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readHeader(path, parser, starts[line])
+	data, _ := os.ReadFile(path)
+	text := strings.SplitN(string(data[starts[line]:]), "\n", 2)[0]
+	logData, err := parser.parseLog(text)
+	if err != nil {
+		t.Fatalf("line at the offset can't be parsed: %v", err)
+	}
+	if want := fmt.Sprintf("/page/%d", line); logData.URL != want {
+		t.Errorf("parsed %s, want %s", logData.URL, want)
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	since, _ := parseWindowTime("2024-10-23T10:00:00Z")
+	until, _ := parseWindowTime("2024-10-23T11:00:00Z")
+	window := timeWindow{Since: since, Until: until}
+
+	tests := []struct {
+		timestamp string
+		includes  bool
+		passed    bool
+	}{
+		{"23/Oct/2024:09:59:59 +0000", false, false},
+		{"23/Oct/2024:12:00:00 +0200", true, false},
+		{"2024-10-23T11:00:00Z", true, false},
+		{"2024-10-23T11:00:30Z", false, false},
+		{"2024-10-23T11:01:01Z", false, true},
+		{"not a time", false, false},
+	}
+	for _, test := range tests {
+		logData := &LogData{Timestamp: test.timestamp}
+		if got := window.includes(logData); got != test.includes {
+			t.Errorf("%s: includes %v, want %v", test.timestamp, got, test.includes)
+		}
+		if got := window.passed(logData); got != test.passed {
+			t.Errorf("%s: passed %v, want %v", test.timestamp, got, test.passed)
+		}
+	}
+
+	if !(timeWindow{}).includes(&LogData{Timestamp: "not a time"}) {
+		t.Error("a line is not in an unset window")
+	}
+}